@@ -13,6 +13,8 @@ var (
 	clobber  bool
 	dryRun   bool
 	verbose  bool
+	nilMode  string
+	marshal  bool
 	rootCmd  = &cobra.Command{
 		Use:                   "bencode_gen [flags] [typename]...\n\nTypename may include '*' to find all tagged structs",
 		Short:                 "Go code generator for writing bencoded data",
@@ -28,6 +30,8 @@ func init() {
 	flags.BoolVarP(&clobber, "force", "f", false, "overwrite files")
 	flags.BoolVarP(&dryRun, "dry-run", "n", false, "don't write any files")
 	flags.BoolVarP(&verbose, "verbose", "v", false, "verbose logging")
+	flags.StringVar(&nilMode, "nil", "error", "default handling of nil pointers: omit, empty or error")
+	flags.BoolVar(&marshal, "marshalers", false, "encode types implementing encoding.BinaryMarshaler or TextMarshaler as strings")
 }
 
 func Execute() {
@@ -49,5 +53,5 @@ func run(cmd *cobra.Command, args []string) {
 		outMode = internal.Overwrite
 	}
 
-	internal.DoGenerate(pkgNames, args, outMode)
+	internal.DoGenerate(pkgNames, args, outMode, internal.Options{NilMode: nilMode, Marshalers: marshal})
 }
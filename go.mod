@@ -1,11 +1,20 @@
 module github.com/predakanga/bencode_gen
 
-go 1.13
+go 1.22.0
 
 require (
 	github.com/dave/jennifer v1.3.0
 	github.com/fatih/structtag v1.1.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v0.0.5
-	golang.org/x/tools v0.0.0-20191014205221-18e3458ac98b
+	golang.org/x/tools v0.26.0
+)
+
+require (
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
+	github.com/spf13/pflag v1.0.3 // indirect
+	golang.org/x/mod v0.21.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.26.0 // indirect
 )
@@ -2,50 +2,128 @@ package internal
 
 import (
 	"fmt"
+	"github.com/fatih/structtag"
 	. "github.com/predakanga/bencode_gen/internal/tokens"
 	log "github.com/sirupsen/logrus"
 	"go/types"
+	"math"
+	"runtime"
 	"sort"
+	"strconv"
 )
 
+// Tag options for durations, mapped to the names of their time and pkg constants
+var durationUnits = map[string]string{
+	"ns":  "Nanosecond",
+	"us":  "Microsecond",
+	"ms":  "Millisecond",
+	"s":   "Second",
+	"min": "Minute",
+	"h":   "Hour",
+}
+var roundingModes = map[string]string{
+	"trunc":   "RoundTrunc",
+	"floor":   "RoundFloor",
+	"ceil":    "RoundCeil",
+	"nearest": "RoundNearest",
+}
+// Values of the compact tag option, mapped to the names of their pkg constants
+var compactFamilies = map[string]string{
+	"":  "CompactAny",
+	"4": "CompactIPv4",
+	"6": "CompactIPv6",
+}
+var nilModes = map[string]NilMode{
+	"error": NilError,
+	"empty": NilEmpty,
+	"omit":  NilOmit,
+}
+
 func (pg *PackageGenerator) typeTokens(selector string, typ types.Type, ctx *typeContext) []CodeToken {
+	// Recursive types would expand forever, so their inner occurrences call a function instead
+	if named, ok := typ.(*types.Named); ok {
+		if ctx.isExpanding(named) {
+			return pg.recursiveTokens(selector, named, ctx)
+		}
+		ctx.expanding = append(ctx.expanding, named)
+		defer func() { ctx.expanding = ctx.expanding[:len(ctx.expanding)-1] }()
+	}
+
 	// Start at the outer-most type and drill down until we find one we support
 	var lastType types.Type
 	curType := typ
 
 	for curType != lastType {
 		// Special cases
+		if _, ok := curType.(*types.TypeParam); ok {
+			// Type parameters may be instantiated with anything, so are dispatched at runtime too
+			return pg.dynamicTokens(selector, curType, ctx)
+		}
+		if _, ok := curType.Underlying().(*types.Interface); ok {
+			// Interfaces can't be dispatched on statically, even if they embed pkg.Bencodable
+			return pg.dynamicTokens(selector, typ, ctx)
+		}
+		if ptr, ok := curType.(*types.Pointer); ok {
+			// Pointers are another special case - for fields, etc, we want to dereference them first
+			// This comes before native support, so that pointers to types with their own methods can be nil
+			return pg.pointerTokens(selector, ptr, ctx)
+		}
 		if types.Implements(curType, pg.bencodeInterface) {
 			log.Debugf("Found native support in %v", curType.String())
-			return pg.nativeTokens(selector)
+			return pg.nativeTokens(selector, curType, ctx)
+		}
+		if named, ok := curType.(*types.Named); ok && pg.isGenerated(named, ctx) {
+			log.Debugf("Found generated support in %v", curType.String())
+			return pg.generatedTokens(selector, named, ctx)
 		}
 		if curType == pg.durationType {
-			return pg.intTokens(selector + ".Seconds()")
+			return pg.durationTokens(selector, ctx)
+		}
+		if curType == pg.bigIntType {
+			return pg.bigIntTokens(selector)
+		}
+		if curType == pg.timeType {
+			return pg.timeTokens(selector, ctx)
+		}
+		if toks := pg.compactTokens(selector, curType, ctx); toks != nil {
+			return toks
+		}
+		if toks := pg.marshalerTokens(selector, curType, ctx); toks != nil {
+			return toks
+		}
+		if curType == pg.addrPortType {
+			panic(fmt.Errorf("netip.AddrPort requires the compact option (%v)", selector))
 		}
 
 		// Basic types
 		switch castType := curType.(type) {
-		case *types.Pointer:
-			// Pointers are another special case - for fields, etc, we want to dereference them first
-			selector = "*" + selector
-			curType = castType.Elem()
-			continue
 		case *types.Struct:
-			return pg.structTokens(selector, castType, ctx)
+			return pg.structTokens(selector, pg.typeString(typ), castType, ctx)
 		case *types.Map:
 			return pg.mapTokens(selector, castType, ctx)
 		case *types.Slice:
-			return pg.listTokens(selector, castType.Elem(), ctx)
+			// Byte slices are strings as far as bencode is concerned
+			if isByte(castType.Elem()) {
+				return pg.stringTokens(selector, typ)
+			}
+			return pg.listTokens(selector, castType.Elem(), false, ctx)
 		case *types.Array:
-			return pg.listTokens(selector, castType.Elem(), ctx)
+			if isByte(castType.Elem()) {
+				return pg.stringTokens(selector, typ)
+			}
+			return pg.listTokens(selector, castType.Elem(), true, ctx)
 		case *types.Basic:
 			switch {
 			case castType.Info()&types.IsBoolean != 0:
-				return pg.boolTokens(selector)
+				return pg.boolTokens(selector, typ)
+			case castType.Info()&types.IsUnsigned != 0:
+				return pg.uintTokens(selector, typ)
 			case castType.Info()&types.IsInteger != 0:
-				return pg.intTokens(selector)
+				return pg.intTokens(selector, typ)
 			case castType.Info()&types.IsString != 0:
-				return pg.stringTokens(selector)
+				return pg.stringTokens(selector, typ)
+			case castType.Info()&types.IsFloat != 0:
+				return pg.floatTokens(selector, typ, ctx)
 			}
 		}
 
@@ -57,105 +135,591 @@ func (pg *PackageGenerator) typeTokens(selector string, typ types.Type, ctx *typ
 	panic(fmt.Errorf("unsupported type: %v", typ))
 }
 
-func (pg *PackageGenerator) boolTokens(selector string) []CodeToken {
+func (pg *PackageGenerator) boolTokens(selector string, typ types.Type) []CodeToken {
 	return []CodeToken{
-		&Const{"i"},
-		&Bool{selector},
-		&Const{"e"},
+		&Const{Data: "i"},
+		&Bool{Data: selector, Type: typ},
+		&Const{Data: "e"},
 	}
 }
 
-func (pg *PackageGenerator) intTokens(selector string) []CodeToken {
+func (pg *PackageGenerator) intTokens(selector string, typ types.Type) []CodeToken {
+	return []CodeToken{
+		&Const{Data: "i"},
+		&Int{Data: selector, Type: typ},
+		&Const{Data: "e"},
+	}
+}
+
+func (pg *PackageGenerator) uintTokens(selector string, typ types.Type) []CodeToken {
+	return []CodeToken{
+		&Const{Data: "i"},
+		&Uint{Data: selector, Type: typ},
+		&Const{Data: "e"},
+	}
+}
+
+// Durations are whole seconds by default, truncated towards zero
+func (pg *PackageGenerator) durationTokens(selector string, ctx *typeContext) []CodeToken {
+	tok := &Duration{Data: selector, Unit: "Second", Rounding: "RoundTrunc"}
+	if unit, ok := ctx.option("unit"); ok {
+		if tok.Unit, ok = durationUnits[unit]; !ok {
+			panic(fmt.Errorf("invalid duration unit for %v: %q", selector, unit))
+		}
+	}
+	if rounding, ok := ctx.option("round"); ok {
+		if tok.Rounding, ok = roundingModes[rounding]; !ok {
+			panic(fmt.Errorf("invalid rounding mode for %v: %q", selector, rounding))
+		}
+	}
+
+	return []CodeToken{
+		&Const{Data: "i"},
+		tok,
+		&Const{Data: "e"},
+	}
+}
+
+func (pg *PackageGenerator) bigIntTokens(selector string) []CodeToken {
+	return []CodeToken{
+		&Const{Data: "i"},
+		&BigInt{Data: selector},
+		&Const{Data: "e"},
+	}
+}
+
+// Times are unix seconds by default, as used by torrent creation dates
+func (pg *PackageGenerator) timeTokens(selector string, ctx *typeContext) []CodeToken {
+	if _, ok := ctx.option("rfc3339"); ok {
+		return []CodeToken{&Time{Data: selector, Format: TimeRFC3339}}
+	}
+
+	format := TimeUnix
+	if _, ok := ctx.option("millis"); ok {
+		format = TimeUnixMillis
+	}
 	return []CodeToken{
-		&Const{"i"},
-		&Int{selector},
-		&Const{"e"},
+		&Const{Data: "i"},
+		&Time{Data: selector, Format: format},
+		&Const{Data: "e"},
+	}
+}
+
+// Addresses are packed into strings as in BEP 23 and BEP 5, but only when asked to with the compact option
+// Returns nil if typ isn't a compact address
+func (pg *PackageGenerator) compactTokens(selector string, typ types.Type, ctx *typeContext) []CodeToken {
+	family, ok := ctx.option("compact")
+	if !ok {
+		return nil
+	}
+
+	tok := &Compact{Data: selector}
+	switch {
+	case typ == pg.addrPortType:
+		tok.Kind = CompactAddrPort
+	case typ == pg.udpAddrType:
+		tok.Kind = CompactUDPAddr
+	case isSliceOf(typ, pg.addrPortType):
+		tok.Kind = CompactAddrPorts
+	default:
+		return nil
+	}
+	if tok.Family, ok = compactFamilies[family]; !ok {
+		panic(fmt.Errorf("invalid compact address family for %v: %q", selector, family))
+	}
+	return []CodeToken{tok}
+}
+
+// Types with their own binary or text form are written as strings, if enabled globally or by the marshal option
+// The option may also be marshal=binary or marshal=text to choose between them; otherwise binary is preferred
+// Returns nil if typ has neither, or marshalers aren't enabled
+func (pg *PackageGenerator) marshalerTokens(selector string, typ types.Type, ctx *typeContext) []CodeToken {
+	form, enabled := ctx.option("marshal")
+	if !enabled && !pg.opts.Marshalers {
+		return nil
+	}
+	if form != "" && form != "binary" && form != "text" {
+		panic(fmt.Errorf("invalid marshal form for %v: %q", selector, form))
+	}
+
+	// Fields are addressable, so pointer receivers can be used too
+	ptr := types.NewPointer(typ)
+	tok := &Marshaler{Data: selector}
+	unmarshaler, unmarshalerName := pg.binaryUnmarshalerInterface, "encoding.BinaryUnmarshaler"
+	switch {
+	case form != "text" && types.Implements(ptr, pg.binaryMarshalerInterface):
+	case form != "binary" && types.Implements(ptr, pg.textMarshalerInterface):
+		tok.Text = true
+		unmarshaler, unmarshalerName = pg.textUnmarshalerInterface, "encoding.TextUnmarshaler"
+	default:
+		return nil
+	}
+	if !types.Implements(ptr, unmarshaler) {
+		ctx.noDecode(fmt.Sprintf("%v does not implement %v", typ, unmarshalerName))
+	}
+	return []CodeToken{tok}
+}
+
+func (pg *PackageGenerator) stringTokens(selector string, typ types.Type) []CodeToken {
+	return []CodeToken{&String{Data: selector, Type: typ}}
+}
+
+// Bencode has no floats, so fields have to choose between a decimal string or a scaled integer
+func (pg *PackageGenerator) floatTokens(selector string, typ types.Type, ctx *typeContext) []CodeToken {
+	if _, ok := ctx.option("string"); ok {
+		return []CodeToken{&Float{Data: selector, Type: typ}}
+	}
+	if scale, ok := ctx.option("scale"); ok {
+		// NaN fails every comparison, so is rejected by checking for a positive scale rather than against zero
+		parsed, err := strconv.ParseFloat(scale, 64)
+		if err != nil || !(parsed > 0) || math.IsInf(parsed, 1) {
+			panic(fmt.Errorf("invalid scale for %v: %q", selector, scale))
+		}
+		return []CodeToken{
+			&Const{Data: "i"},
+			// Reformatted, as ParseFloat accepts spellings which aren't Go literals, such as "Inf" or "0x1p-2"
+			&Float{Data: selector, Type: typ, Scale: strconv.FormatFloat(parsed, 'g', -1, 64)},
+			&Const{Data: "e"},
+		}
+	}
+	panic(fmt.Errorf("unsupported type: %v (%v needs either the string or scale= tag option)", typ, selector))
+}
+
+func (pg *PackageGenerator) nativeTokens(selector string, typ types.Type, ctx *typeContext) []CodeToken {
+	// Decoding requires the matching ReadFrom method, on the type itself or through a pointer to it
+	if types.Implements(typ, pg.unmarshalerInterface) {
+		// Pointers must be allocated before calling their ReadFrom
+		if ptr, ok := typ.Underlying().(*types.Pointer); ok {
+			return []CodeToken{&Alloc{Selector: selector, Elem: ptr.Elem()}, &Native{Data: selector}}
+		}
+	} else if !types.Implements(types.NewPointer(typ), pg.unmarshalerInterface) {
+		ctx.noDecode(fmt.Sprintf("%v does not implement pkg.Unmarshaler", typ))
+	}
+	return []CodeToken{&Native{Data: selector}}
+}
+
+// isGenerated reports whether a type is being generated in this run, other than the one being generated now
+func (pg *PackageGenerator) isGenerated(named *types.Named, ctx *typeContext) bool {
+	if ctx.Self != nil && sameNamed(ctx.Self, named) {
+		return false
+	}
+	_, ok := pg.generated[named.Origin().Obj()]
+	return ok
+}
+
+// generatedTokens calls the methods of a type being generated in this run, which don't exist yet
+// Whether it gets a ReadFrom is only known once every type has been generated, so the use is recorded instead
+func (pg *PackageGenerator) generatedTokens(selector string, named *types.Named, ctx *typeContext) []CodeToken {
+	ctx.uses = append(ctx.uses, named.Origin().Obj())
+	return []CodeToken{&Native{Data: selector}}
+}
+
+// Interfaces are encoded by a runtime type switch, and decoded only if they can hold any value
+// Type parameters are always decoded, as their concrete type is known by then
+func (pg *PackageGenerator) dynamicTokens(selector string, typ types.Type, ctx *typeContext) []CodeToken {
+	_, isTypeParam := typ.(*types.TypeParam)
+	if !isTypeParam && !typ.Underlying().(*types.Interface).Empty() {
+		ctx.noDecode(fmt.Sprintf("%v is a non-empty interface", typ))
+	}
+	return []CodeToken{&Dynamic{Data: selector, Type: typ}}
+}
+
+// recursiveTokens encodes a type which contains itself, by calling a function rather than inlining it again
+// The type being generated calls its own methods, while any other type gets a pair of helper functions
+func (pg *PackageGenerator) recursiveTokens(selector string, named *types.Named, ctx *typeContext) []CodeToken {
+	if ctx.Self != nil && sameNamed(ctx.Self, named) {
+		return []CodeToken{&Native{Data: selector}}
+	}
+	if len(typeArgs(named)) != 0 {
+		panic(fmt.Errorf("unsupported recursive generic type: %v (%v)", named, selector))
+	}
+	// Helpers take a pointer to the type, which can't be named outside its package if it's unexported
+	if obj := named.Obj(); !obj.Exported() && obj.Pkg() != pg.pkg.Types {
+		panic(fmt.Errorf("%v: recursive type %v is unexported, so it can't be encoded from package %v (%v)",
+			pg.pkg.Fset.Position(obj.Pos()), pg.typeString(named), pg.pkg.Name, selector))
+	}
+
+	helper := pg.helper(named)
+	return []CodeToken{&Helper{Data: selector, Encoder: helper.Encoder, Decoder: helper.Decoder}}
+}
+
+func (pg *PackageGenerator) pointerTokens(selector string, typ *types.Pointer, ctx *typeContext) []CodeToken {
+	ptr := &Pointer{
+		Selector: selector,
+		Elem:     typ.Elem(),
+		Nil:      pg.nilMode(selector, ctx),
+		Path:     ctx.Path,
+	}
+	// Nil values can only be omitted by an enclosing field, list or map, so fall back to an error elsewhere
+	if ctx.skipNil {
+		ptr.Nil = NilOmit
+	} else if ptr.Nil == NilOmit {
+		ptr.Nil = NilError
+	}
+	ctx.skipNil = false
+
+	if ptr.Nil == NilEmpty {
+		// The zero value would contain another nil pointer to encode as empty, and so on forever
+		if pg.emptyRecurses(typ.Elem(), ctx.Tag, nil) {
+			pos := pg.pkg.Fset.Position(typ.Elem().(*types.Named).Obj().Pos())
+			if ctx.Field != nil {
+				pos = pg.pkg.Fset.Position(ctx.Field.Pos())
+			}
+			panic(fmt.Errorf("%v: nil pointers to %v can't be encoded as empty, as its zero value contains another (%v)",
+				pos, pg.typeString(typ.Elem()), ctx.Path))
+		}
+		ptr.Zero = ctx.ident("zero")
+		// These are only encoded, and aren't part of the pointer's contents, so merge their consts here
+		ptr.Empty = MergeConsts(pg.elemTokens(ptr.Zero, typ, ctx))
 	}
+	ptr.Children = pg.elemTokens("(*"+selector+")", typ, ctx)
+
+	return []CodeToken{ptr}
 }
 
-func (pg *PackageGenerator) stringTokens(selector string) []CodeToken {
-	return []CodeToken{&String{selector}}
+// elemTokens encodes the value a pointer points to
+// Methods with pointer receivers are called through the dereferenced pointer, as they are for generated types
+func (pg *PackageGenerator) elemTokens(selector string, typ *types.Pointer, ctx *typeContext) []CodeToken {
+	if types.Implements(typ, pg.bencodeInterface) {
+		log.Debugf("Found native support in %v", typ.String())
+		return pg.nativeTokens(selector, typ.Elem(), ctx)
+	}
+	return pg.typeTokens(selector, typ.Elem(), ctx)
 }
 
-func (pg *PackageGenerator) nativeTokens(selector string) []CodeToken {
-	return []CodeToken{&Native{selector}}
+// emptyRecurses reports whether encoding the zero value of typ would encode an empty value of itself, or of a type
+// in seen, through nil pointers which are encoded as empty
+func (pg *PackageGenerator) emptyRecurses(typ types.Type, tag *structtag.Tag, seen []types.Type) bool {
+	// Only our own types contain pointers which we'll encode; everything else writes itself
+	if types.Implements(typ, pg.bencodeInterface) || types.Implements(types.NewPointer(typ), pg.bencodeInterface) ||
+		typ == pg.durationType || typ == pg.bigIntType ||
+		typ == pg.timeType || typ == pg.addrPortType || typ == pg.udpAddrType {
+		return false
+	}
+	if _, ok := typ.(*types.Named); ok {
+		for _, outer := range seen {
+			if types.Identical(outer, typ) {
+				return true
+			}
+		}
+		seen = append(seen, typ)
+	}
+
+	switch castType := typ.Underlying().(type) {
+	case *types.Pointer:
+		ctx := &typeContext{Tag: tag}
+		if pg.nilMode("", ctx) != NilEmpty {
+			return false
+		}
+		return pg.emptyRecurses(castType.Elem(), tag, seen)
+	case *types.Array:
+		return pg.emptyRecurses(castType.Elem(), tag, seen)
+	case *types.Struct:
+		name := pg.typeString(typ)
+		for _, f := range pg.structFields(name, castType) {
+			ctx := &typeContext{Tag: f.Tag}
+			_, hasEncoder := ctx.option("encoder")
+			if hasEncoder || f.Tag != nil && f.Tag.HasOption("omitempty") || len(f.Pointers) != 0 {
+				continue
+			}
+			if pg.emptyRecurses(f.Field.Type(), f.Tag, seen) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func (pg *PackageGenerator) listTokens(selector string, elemType types.Type, ctx *typeContext) []CodeToken {
+// nilMode returns the nil handling for a pointer, which defaults to the generator's option
+func (pg *PackageGenerator) nilMode(selector string, ctx *typeContext) NilMode {
+	name, ok := ctx.option("nil")
+	if !ok {
+		name = pg.opts.NilMode
+	}
+	mode, ok := nilModes[name]
+	if !ok {
+		panic(fmt.Errorf("invalid nil mode for %v: %q", selector, name))
+	}
+	return mode
+}
+
+// skipsNil reports whether nil values of typ should be left out by the enclosing field, list or map
+func (pg *PackageGenerator) skipsNil(selector string, typ types.Type, ctx *typeContext) bool {
+	if _, ok := typ.Underlying().(*types.Pointer); !ok {
+		return false
+	}
+	return pg.nilMode(selector, ctx) == NilOmit
+}
+
+func (pg *PackageGenerator) listTokens(selector string, elemType types.Type, isArray bool, ctx *typeContext) []CodeToken {
+	list := &List{
+		Selector: selector,
+		Var:      ctx.ident("i"),
+		Elem:     elemType,
+		Array:    isArray,
+	}
+	if isArray {
+		list.Index = ctx.ident("n")
+	}
+	list.SkipNil = pg.skipsNil(selector, elemType, ctx)
+
+	outerPath := ctx.Path
+	ctx.Path += "[]"
+	ctx.skipNil = list.SkipNil
+	list.Children = pg.typeTokens(list.Var, elemType, ctx)
+	ctx.Path, ctx.skipNil = outerPath, false
+
 	return []CodeToken{
-		&Const{"l"},
-		&List{
-			selector,
-			pg.typeTokens("i", elemType, ctx),
-		},
-		&Const{"e"},
+		&Const{Data: "l"},
+		list,
+		&Const{Data: "e"},
 	}
 }
 
 func (pg *PackageGenerator) mapTokens(selector string, typ *types.Map, ctx *typeContext) []CodeToken {
-	var castTo *types.TypeName
-	// TODO: Possibly extend this to support go.Stringer
 	keyType := typ.Key()
 	valType := typ.Elem()
-	if !isString(keyType) {
-		log.Fatalf("Can't encode %v: map keys may only be strings (not %v)", selector, keyType)
-	}
-	// Tell the type generator that we'll need the mapKeys var
-	ctx.NeedsSort = true
 
-	if namedType, ok := keyType.(*types.Named); ok {
-		castTo = namedType.Obj()
-	} else if _, ok := keyType.(*types.Basic); !ok {
-		log.Fatalf("Can't encode %v: expected types.Named or types.Basic, got %T", selector, keyType)
+	m := &Map{
+		Selector: selector,
+		Type:     typ,
+		Keys:     ctx.ident("mapKeys"),
 	}
+	// Stringers are opt-in, as their output is rarely unique or reversible
+	_, allowStringer := ctx.option("stringer")
+	switch {
+	case isString(keyType):
+		m.KeyKind = KeyString
+	case types.Implements(keyType, pg.textMarshalerInterface):
+		m.KeyKind = KeyText
+		_, isPointer := keyType.Underlying().(*types.Pointer)
+		if isPointer || !types.Implements(types.NewPointer(keyType), pg.textUnmarshalerInterface) {
+			ctx.noDecode(fmt.Sprintf("map key %v does not implement encoding.TextUnmarshaler", keyType))
+		}
+	case types.Implements(keyType, pg.stringerInterface) && allowStringer:
+		m.KeyKind = KeyStringer
+		ctx.noDecode(fmt.Sprintf("map key %v is a fmt.Stringer, which can't be reversed", keyType))
+	case isInteger(keyType):
+		// Integers are written in decimal, so are still sorted as strings rather than numerically
+		m.KeyKind = KeyInt
+		if isUnsigned(keyType) {
+			m.KeyKind = KeyUint
+		}
+	case isByteArray(keyType):
+		// Raw hashes are written as-is, as in the piece layers of BEP 52
+		m.KeyKind = KeyBytes
+	default:
+		panic(fmt.Errorf("can't encode %v: map keys must be strings, integers, byte arrays or implement encoding.TextMarshaler (not %v)", selector, keyType))
+	}
+	// Other than strings and byte arrays, keys need to be looked up again after sorting
+	if m.KeyKind != KeyString && m.KeyKind != KeyBytes {
+		m.Lookup = ctx.ident("keyLookup")
+	}
+
+	m.Str = ctx.ident("idx")
+	m.KeyVar = ctx.ident("k")
+	m.Var = ctx.ident("v")
+	m.Key = pg.typeTokens(m.Str, types.Typ[types.String], ctx)
+	m.SkipNil = pg.skipsNil(selector, valType, ctx)
 
-	childTokens := pg.typeTokens("idx", keyType, ctx)
-	childTokens = append(childTokens, pg.typeTokens(selector+"[k]", valType, ctx)...)
+	outerPath := ctx.Path
+	ctx.Path += "[]"
+	ctx.skipNil = m.SkipNil
+	m.Children = pg.typeTokens(m.Var, valType, ctx)
+	ctx.Path, ctx.skipNil = outerPath, false
 
 	return []CodeToken{
-		&Const{"d"},
-		&Map{
-			selector,
-			castTo,
-			childTokens,
-		},
-		&Const{"e"},
+		&Const{Data: "d"},
+		m,
+		&Const{Data: "e"},
 	}
 }
 
-func (pg *PackageGenerator) structTokens(selector string, typ *types.Struct, ctx *typeContext) (toRet []CodeToken) {
-	// Dict keys must be sorted, so fetch the fields and sort them
-	var fields FieldSlice
-	walkStruct(typ.String(), typ, func(f FieldInfo) bool {
-		fields = append(fields, f)
-		return true
-	})
-	sort.Sort(fields)
-
-	toRet = []CodeToken{&Const{"d"}}
-	for _, f := range fields {
-		var fieldTokens []CodeToken
+func (pg *PackageGenerator) structTokens(selector string, name string, typ *types.Struct, ctx *typeContext) []CodeToken {
+	if isTuple(typ) {
+		return pg.tupleTokens(selector, name, typ, ctx)
+	}
 
-		// First output the (const) field name
-		outputName := f.OutputName()
-		fieldTokens = append(fieldTokens, &Const{fmt.Sprintf("%d:%s", len(outputName), outputName)})
+	// Other packages' structs may hide everything in unexported fields, which would silently encode as an empty dict
+	fields := pg.structFields(name, typ)
+	if len(fields) == 0 && typ.NumFields() != 0 && typ.Field(0).Pkg() != pg.pkg.Types {
+		panic(fmt.Errorf("%v has no exported fields to encode; it needs the marshal option or a custom encoder (%v)", name, selector))
+	}
 
-		// Then encode the value
+	dict := &Dict{}
+	for _, f := range fields {
+		// Output the (const) field name, then encode the value according to the field's tag
 		fieldSelector := selector + "." + f.Name
-		fieldTokens = append(fieldTokens, pg.typeTokens(fieldSelector, f.Field.Type(), ctx)...)
+		outerTag, outerField, outerPath := ctx.Tag, ctx.Field, ctx.Path
+		ctx.Tag, ctx.Field = f.Tag, f.Field
+		ctx.Path += "." + f.Name
+		omitNil := pg.skipsNil(fieldSelector, f.Field.Type(), ctx)
+		omitEmpty := f.Tag != nil && f.Tag.HasOption("omitempty")
+		// Empty pointers are nil, so omitempty skips them too
+		_, isPointer := f.Field.Type().Underlying().(*types.Pointer)
+		ctx.skipNil = omitNil || (omitEmpty && isPointer)
+		field := &Field{Key: f.OutputName()}
+		// Fields promoted through embedded pointers need them allocated before they can be decoded into
+		for _, ptr := range f.Pointers {
+			ptrSelector := selector + "." + ptr.Name
+			field.Children = append(field.Children, &Alloc{Selector: ptrSelector, Elem: ptr.Field.Type().Underlying().(*types.Pointer).Elem()})
+		}
+		field.Children = append(field.Children, pg.fieldTokens(fieldSelector, f.Field.Type(), ctx)...)
+		ctx.Tag, ctx.Field, ctx.Path, ctx.skipNil = outerTag, outerField, outerPath, false
 
-		// Wrap it in an omit-empty token if need be and store it
-		if f.Tag != nil && f.Tag.HasOption("omitempty") {
-			emptyMethod := emptyMethod(f.Field.Type().Underlying())
+		// Wrap it in an omit-empty token if need be
+		var tok CodeToken = field
+		if omitNil {
+			tok = &OmitEmpty{Selector: fieldSelector, EmptyMethod: "nil", Children: []CodeToken{tok}}
+		} else if omitEmpty {
+			emptyMethod := emptyMethod(f.Field.Type())
 			if emptyMethod == "" {
 				panic(fmt.Errorf("omitempty is not supported by type %v (field %v)", f.Field.Type(), fieldSelector))
 			}
-			toRet = append(toRet, &OmitEmpty{fieldSelector, emptyMethod, fieldTokens})
-		} else {
-			toRet = append(toRet, fieldTokens...)
+			tok = &OmitEmpty{Selector: fieldSelector, EmptyMethod: emptyMethod, Children: []CodeToken{tok}}
 		}
+		// And leave it out altogether if any of the embedded pointers it's promoted through are nil
+		for i := len(f.Pointers) - 1; i >= 0; i-- {
+			tok = &OmitEmpty{Selector: selector + "." + f.Pointers[i].Name, EmptyMethod: "nil", Children: []CodeToken{tok}}
+		}
+		dict.Fields = append(dict.Fields, tok)
 	}
-	toRet = append(toRet, &Const{"e"})
 
-	return
+	return []CodeToken{
+		&Const{Data: "d"},
+		dict,
+		&Const{Data: "e"},
+	}
+}
+
+// fieldTokens encodes a struct field, using the functions named by its encoder and decoder options if it has them
+// Unlike other options, these only apply to the field itself, not its elements
+func (pg *PackageGenerator) fieldTokens(selector string, typ types.Type, ctx *typeContext) []CodeToken {
+	encoder, hasEncoder := ctx.option("encoder")
+	decoder, hasDecoder := ctx.option("decoder")
+	if !hasEncoder && !hasDecoder {
+		return pg.typeTokens(selector, typ, ctx)
+	}
+
+	custom := &Custom{Data: selector}
+	if hasEncoder {
+		pg.checkCustomFunc(selector, encoder, pg.writerType, typ)
+		custom.Encoder = encoder
+	}
+	if hasDecoder {
+		pg.checkCustomFunc(selector, decoder, pg.readerType, types.NewPointer(typ))
+		custom.Decoder = decoder
+	}
+	if !hasEncoder || !hasDecoder {
+		// Custom functions are the escape hatch for unsupported types, so only the missing half needs to work
+		children, err := pg.tryTypeTokens(selector, typ, ctx)
+		switch {
+		case err == nil:
+			custom.Children = children
+		case hasDecoder:
+			panic(fmt.Errorf("%v (field %v needs the encoder option as well as decoder)", err, selector))
+		default:
+			ctx.noDecode(fmt.Sprintf("%v has no decoder option, and %v", selector, err))
+		}
+	}
+	return []CodeToken{custom}
+}
+
+// tryTypeTokens is typeTokens, but returns an error rather than panicking if typ can't be encoded
+func (pg *PackageGenerator) tryTypeTokens(selector string, typ types.Type, ctx *typeContext) (toks []CodeToken, err error) {
+	// Panics skip restoring the context, so it's restored wholesale
+	saved := *ctx
+	defer func() {
+		if r := recover(); r != nil {
+			var ok bool
+			if err, ok = r.(error); !ok {
+				panic(r)
+			}
+			if _, isRuntime := r.(runtime.Error); isRuntime {
+				panic(r)
+			}
+			*ctx = saved
+			toks = nil
+		}
+	}()
+	return pg.typeTokens(selector, typ, ctx), nil
+}
+
+// checkCustomFunc makes sure that name is a package-level function which can be called as name(rw, value)
+func (pg *PackageGenerator) checkCustomFunc(selector string, name string, rw types.Type, value types.Type) {
+	fn, ok := pg.pkg.Types.Scope().Lookup(name).(*types.Func)
+	if !ok {
+		panic(fmt.Errorf("%v is not a function in %v (field %v)", name, pg.pkg.PkgPath, selector))
+	}
+	sig := fn.Type().(*types.Signature)
+	params, results := sig.Params(), sig.Results()
+	if sig.TypeParams().Len() != 0 || sig.Variadic() || params.Len() != 2 || results.Len() != 1 ||
+		!types.AssignableTo(rw, params.At(0).Type()) || !types.AssignableTo(value, params.At(1).Type()) ||
+		!types.Identical(results.At(0).Type(), types.Universe.Lookup("error").Type()) {
+		panic(fmt.Errorf("%v must have the signature func(%v, %v) error (field %v)", name,
+			pg.typeString(rw), pg.typeString(value), selector))
+	}
+}
+
+// typeString renders a type for messages, qualifying types from other packages with their package's name
+func (pg *PackageGenerator) typeString(typ types.Type) string {
+	return types.TypeString(typ, func(p *types.Package) string {
+		if p == pg.pkg.Types {
+			return ""
+		}
+		return p.Name()
+	})
+}
+
+// Tuples are encoded as a list of their fields' values, in declaration order
+func (pg *PackageGenerator) tupleTokens(selector string, name string, typ *types.Struct, ctx *typeContext) []CodeToken {
+	tuple := &Tuple{}
+	for _, f := range pg.structFields(name, typ) {
+		// Elements are positional, so can't be left out
+		fieldSelector := selector + "." + f.Name
+		if f.Tag != nil && f.Tag.HasOption("omitempty") {
+			panic(fmt.Errorf("omitempty is not supported in tuples (field %v)", fieldSelector))
+		}
+		if len(f.Pointers) != 0 {
+			panic(fmt.Errorf("fields promoted through embedded pointers are not supported in tuples (field %v)", fieldSelector))
+		}
+
+		outerTag, outerField, outerPath := ctx.Tag, ctx.Field, ctx.Path
+		ctx.Tag, ctx.Field = f.Tag, f.Field
+		ctx.Path += "." + f.Name
+		tuple.Elems = append(tuple.Elems, pg.fieldTokens(fieldSelector, f.Field.Type(), ctx)...)
+		ctx.Tag, ctx.Field, ctx.Path = outerTag, outerField, outerPath
+	}
+
+	return []CodeToken{
+		&Const{Data: "l"},
+		tuple,
+		&Const{Data: "e"},
+	}
+}
+
+// structFields returns the fields to be encoded for a struct, in canonical order
+// Tuples keep their declaration order instead
+// Results are cached, as each type is walked for both its encoder and decoder
+func (pg *PackageGenerator) structFields(name string, typ *types.Struct) FieldSlice {
+	if fields, ok := pg.fieldCache[typ]; ok {
+		return fields
+	}
+
+	var fields FieldSlice
+	walkStruct(pg.pkg.Types, name, typ, func(f FieldInfo) bool {
+		fields = append(fields, f)
+		return true
+	})
+	fields = dominantFields(pg.pkg.Fset, name, fields)
+	// Dict keys must be sorted by their raw bytes (BEP 3), so sort the fields by output name
+	if !isTuple(typ) {
+		sort.Sort(fields)
+	}
+
+	if pg.fieldCache == nil {
+		pg.fieldCache = make(map[*types.Struct]FieldSlice)
+	}
+	pg.fieldCache[typ] = fields
+	return fields
 }
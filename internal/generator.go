@@ -7,7 +7,6 @@ import (
 	"github.com/predakanga/bencode_gen/internal/tokens"
 	"github.com/predakanga/bencode_gen/pkg"
 	log "github.com/sirupsen/logrus"
-	"go/ast"
 	"go/token"
 	"go/types"
 	"golang.org/x/tools/go/packages"
@@ -18,30 +17,39 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 )
 
 const DoNotEditHeader = "Code generated by %v %v DO NOT EDIT."
+
 var autogenRegex = regexp.MustCompile(`(?m)^// Code generated .* DO NOT EDIT\.$`)
-var forcePackages = []string{"github.com/predakanga/bencode_gen/pkg", "time"}
+
+const pkgPath = "github.com/predakanga/bencode_gen/pkg"
+
+// Kept sorted, for strContains
+var forcePackages = []string{"encoding", "fmt", pkgPath, "math/big", "net", "net/netip", "time"}
 
 var pkgCfg = packages.Config{
 	Mode: packages.NeedName |
 		packages.NeedFiles |
 		packages.NeedImports |
+		packages.NeedDeps |
 		packages.NeedTypes |
 		packages.NeedTypesInfo,
 	Fset:       token.NewFileSet(),
 	BuildFlags: []string{"-tags", "generate"},
 }
 
-
-func DoGenerate(packageNames []string, typeNames []string, mode OutputMode) {
+func DoGenerate(packageNames []string, typeNames []string, mode OutputMode, opts Options) {
 	log.Debugf("Got packageNames: %#v", packageNames)
+	if _, ok := nilModes[opts.NilMode]; !ok {
+		log.Fatalf("Invalid nil mode: %q", opts.NilMode)
+	}
 	// Sort the type names, to make it easier to check membership
 	sort.Strings(typeNames)
 
-	// Make sure we always load ourselves and time (for interfaces)
+	// Make sure we always load ourselves and the standard packages we have special cases for
 	packageNames = append(packageNames, forcePackages...)
 	// Load the packages
 	pkgs, err := packages.Load(&pkgCfg, packageNames...)
@@ -49,25 +57,25 @@ func DoGenerate(packageNames []string, typeNames []string, mode OutputMode) {
 		log.Fatalf("Couldn't load packages: %v", err)
 	}
 
-	// Find our requisite interfaces
-	var bencodeInterface *types.Interface
-	var durationType types.Type
-	for _, pkg := range pkgs {
-		if pkg.PkgPath == "github.com/predakanga/bencode_gen/pkg" {
-			bencodeInterface = pkg.Types.Scope().Lookup("Bencodable").Type().Underlying().(*types.Interface)
-		}
-		if pkg.PkgPath == "time" {
-			durationType = pkg.Types.Scope().Lookup("Duration").Type()
-		}
-	}
-	if bencodeInterface == nil {
-		log.Fatalf("Could not locate type: github.com/predakanga/bencode_gen/pkg.Bencodable")
-	}
-	if durationType == nil {
-		log.Fatalf("Could not locate type: time.Duration")
-	}
+	// Find our requisite interfaces and special types
+	bencodeInterface := lookupType(pkgs, pkgPath, "Bencodable").Underlying().(*types.Interface)
+	unmarshalerInterface := lookupType(pkgs, pkgPath, "Unmarshaler").Underlying().(*types.Interface)
+	writerType := lookupType(pkgs, pkgPath, "Writer")
+	readerType := lookupType(pkgs, pkgPath, "Reader")
+	textMarshalerInterface := lookupType(pkgs, "encoding", "TextMarshaler").Underlying().(*types.Interface)
+	textUnmarshalerInterface := lookupType(pkgs, "encoding", "TextUnmarshaler").Underlying().(*types.Interface)
+	binaryMarshalerInterface := lookupType(pkgs, "encoding", "BinaryMarshaler").Underlying().(*types.Interface)
+	binaryUnmarshalerInterface := lookupType(pkgs, "encoding", "BinaryUnmarshaler").Underlying().(*types.Interface)
+	stringerInterface := lookupType(pkgs, "fmt", "Stringer").Underlying().(*types.Interface)
+	durationType := lookupType(pkgs, "time", "Duration")
+	timeType := lookupType(pkgs, "time", "Time")
+	bigIntType := lookupType(pkgs, "math/big", "Int")
+	addrPortType := lookupType(pkgs, "net/netip", "AddrPort")
+	udpAddrType := lookupType(pkgs, "net", "UDPAddr")
 
-	// Check each package for interesting types
+	// Find the types to generate in each package up front, so that they can call each other's methods
+	generated := make(map[*types.TypeName]*PackageGenerator)
+	var pkgGens []*PackageGenerator
 	for _, pkg := range pkgs {
 		if strContains(forcePackages, pkg.PkgPath) {
 			continue
@@ -76,39 +84,110 @@ func DoGenerate(packageNames []string, typeNames []string, mode OutputMode) {
 		for k, v := range pkg.TypesInfo.Defs {
 			if interestingDef(k, v, typeNames) {
 				pkgGen := &PackageGenerator{
-					pkg:              pkg,
-					bencodeInterface: bencodeInterface,
-					durationType:     durationType,
+					pkg:                        pkg,
+					opts:                       opts,
+					generated:                  generated,
+					bencodeInterface:           bencodeInterface,
+					unmarshalerInterface:       unmarshalerInterface,
+					writerType:                 writerType,
+					readerType:                 readerType,
+					textMarshalerInterface:     textMarshalerInterface,
+					textUnmarshalerInterface:   textUnmarshalerInterface,
+					binaryMarshalerInterface:   binaryMarshalerInterface,
+					binaryUnmarshalerInterface: binaryUnmarshalerInterface,
+					stringerInterface:          stringerInterface,
+					durationType:               durationType,
+					bigIntType:                 bigIntType,
+					timeType:                   timeType,
+					addrPortType:               addrPortType,
+					udpAddrType:                udpAddrType,
 				}
-				pkgGen.Generate(typeNames, mode)
+				pkgGen.findTypes(typeNames)
+				pkgGens = append(pkgGens, pkgGen)
 				break
 			}
 		}
 	}
+
+	// Then generate them, which has to finish before we know which can be decoded
+	for _, pkgGen := range pkgGens {
+		pkgGen.generateTypes()
+	}
+	dropUndecodable(generated, pkgGens)
+	for _, pkgGen := range pkgGens {
+		pkgGen.Generate(mode)
+	}
 }
 
 type PackageGenerator struct {
-	pkg              *packages.Package
-	bencodeInterface *types.Interface
-	durationType     types.Type
-	types map[string][]tokens.CodeToken
+	pkg  *packages.Package
+	opts Options
+	// Every type being generated in this run, shared by all packages' generators
+	generated                  map[*types.TypeName]*PackageGenerator
+	genTypes                   []types.Object
+	bencodeInterface           *types.Interface
+	unmarshalerInterface       *types.Interface
+	writerType                 types.Type
+	readerType                 types.Type
+	textMarshalerInterface     *types.Interface
+	textUnmarshalerInterface   *types.Interface
+	binaryMarshalerInterface   *types.Interface
+	binaryUnmarshalerInterface *types.Interface
+	stringerInterface          *types.Interface
+	durationType               types.Type
+	bigIntType                 types.Type
+	timeType                   types.Type
+	addrPortType               types.Type
+	udpAddrType                types.Type
+	types                      map[string][]tokens.CodeToken
+	decoders                   map[string][]tokens.CodeToken
+	helpers                    map[*types.TypeName]*helperFunc
+	// The generated types whose methods each type calls, which it can only be decoded alongside
+	uses       map[string][]*types.TypeName
+	fieldCache map[*types.Struct]FieldSlice
+}
+
+// helperFunc is a pair of generated functions for a recursive type which isn't being generated itself
+// Decoder is empty if the type can't be decoded
+type helperFunc struct {
+	Type    *types.Named
+	Encoder string
+	Decoder string
+	encoder []tokens.CodeToken
+	decoder []tokens.CodeToken
+	uses    []*types.TypeName
+}
+
+// lookupType finds a type in one of our forced packages
+func lookupType(pkgs []*packages.Package, pkgPath string, name string) types.Type {
+	for _, pkg := range pkgs {
+		if pkg.PkgPath != pkgPath {
+			continue
+		}
+		if obj := pkg.Types.Scope().Lookup(name); obj != nil {
+			return obj.Type()
+		}
+	}
+	log.Fatalf("Could not locate type: %v.%v", pkgPath, name)
+	return nil
 }
 
-func (pg *PackageGenerator) Generate(typeNames []string, mode OutputMode) {
+func (pg *PackageGenerator) Generate(mode OutputMode) {
 	// Determine our output file
 	if len(pg.pkg.GoFiles) == 0 {
 		log.Fatalf("Could not determine package location for %v", pg.pkg)
 	}
 	outDir := filepath.Dir(pg.pkg.GoFiles[0])
 	outPath := filepath.Join(outDir, "bencode_gen.go") // Make sure any existing file is our own
-	log.Printf("Generating bencoders for %v (%v)", pg.pkg, outPath)
-
-	// Build up our output-tree
-	generatedTypes := pg.generateForTypeNames(typeNames)
-	if len(generatedTypes) == 0 {
+	if len(pg.genTypes) == 0 {
 		log.Printf("Skipping %v - no valid types found", pg.pkg)
 		return
 	}
+	log.Printf("Writing bencoders for %v (%v)", pg.pkg, outPath)
+	generatedTypes := make([]string, 0, len(pg.genTypes))
+	for _, obj := range pg.genTypes {
+		generatedTypes = append(generatedTypes, obj.Name())
+	}
 
 	// Then output if necessary
 	if mode != DryRun {
@@ -149,15 +228,16 @@ func (pg *PackageGenerator) Generate(typeNames []string, mode OutputMode) {
 	}
 
 	// And finally, inform the user
-	log.Printf("Wrote %v with encoders for %v", outPath, strings.Join(generatedTypes, ", "))
+	log.Printf("Wrote %v with bencoders for %v", outPath, strings.Join(generatedTypes, ", "))
 }
 
-func (pg *PackageGenerator) generateForTypeNames(names []string) (genTypes []string) {
+// findTypes finds the types we want, and registers them as being generated
+func (pg *PackageGenerator) findTypes(names []string) {
 	includeTaggedStructs := len(names) == 0 || strContains(names, "*")
 
-	// Find out what types we want, and generate them
 	for id, obj := range pg.pkg.TypesInfo.Defs {
-		if id.Obj == nil || id.Obj.Kind != ast.Typ {
+		typeName, ok := typeDef(id, obj)
+		if !ok {
 			continue
 		}
 
@@ -165,41 +245,153 @@ func (pg *PackageGenerator) generateForTypeNames(names []string) (genTypes []str
 			continue
 		}
 
-		if strContains(names, id.Name) || (includeTaggedStructs && structHasTag(obj.Type(), id.Name)) {
-			genTypes = append(genTypes, id.Name)
-			pg.generateForType(id, obj)
+		if strContains(names, id.Name) || (includeTaggedStructs && structHasTag(obj.Type(), obj.Pkg(), id.Name)) {
+			pg.genTypes = append(pg.genTypes, obj)
+			pg.generated[typeName] = pg
 		}
 	}
+}
 
-	return
+func (pg *PackageGenerator) generateTypes() {
+	log.Printf("Generating bencoders for %v", pg.pkg)
+	for _, obj := range pg.genTypes {
+		pg.generateForType(obj)
+	}
 }
 
-func (pg *PackageGenerator) generateForType(id *ast.Ident, obj types.Object) {
-	log.Debugf("Generating implementation for %v", id.Name)
+func (pg *PackageGenerator) generateForType(obj types.Object) {
+	log.Debugf("Generating implementation for %v", obj.Name())
 
 	// Set up a panic handler to allow *Tokens functions to panic
 	defer func() {
 		err := recover()
 		if err != nil {
-			log.Fatalf("Failed to generate type %v - %v", id.Name, err)
+			log.Fatalf("Failed to generate type %v - %v", obj.Name(), err)
 		}
 	}()
 
+	selector := receiverSelector(obj.Type())
+	self, _ := obj.Type().(*types.Named)
+
 	// Get the token list for this type
-	ctx := typeContext{}
-	toks := pg.typeTokens("x", obj.Type(), &ctx)
+	ctx := typeContext{Path: obj.Name(), Self: self}
+	toks := pg.typeTokens(selector, obj.Type(), &ctx)
 	// Optimization passes
 	toks = tokens.MergeConsts(toks)
 
 	// And store it
-	if ctx.NeedsSort {
-		toks = append([]tokens.CodeToken{&tokens.MapSort{}}, toks...)
-	}
-
 	if pg.types == nil {
 		pg.types = make(map[string][]tokens.CodeToken)
+		pg.decoders = make(map[string][]tokens.CodeToken)
+		pg.uses = make(map[string][]*types.TypeName)
+	}
+	pg.types[obj.Name()] = toks
+	pg.uses[obj.Name()] = ctx.uses
+
+	// Decoders are rendered from the unoptimized token list, as they need the original structure
+	if len(ctx.NoDecode) != 0 {
+		log.Warnf("Not generating a decoder for %v: %v", obj.Name(), strings.Join(ctx.NoDecode, ", "))
+		return
+	}
+	pg.decoders[obj.Name()] = pg.typeTokens(selector, obj.Type(), &typeContext{Path: obj.Name(), Self: self})
+}
+
+// helperNameTaken reports whether a helper already uses the given name
+func (pg *PackageGenerator) helperNameTaken(name string) bool {
+	for _, helper := range pg.helpers {
+		if helper.Encoder == "bencodeWrite"+name {
+			return true
+		}
+	}
+	return false
+}
+
+// helper returns the helper functions for a recursive type, generating them on first use
+func (pg *PackageGenerator) helper(named *types.Named) *helperFunc {
+	obj := named.Obj()
+	if helper, ok := pg.helpers[obj]; ok {
+		return helper
+	}
+
+	// Types from other packages are prefixed with their package's name, to keep them apart
+	// That may still clash, such as a local BTree and b.Tree, so later ones are numbered
+	base := obj.Name()
+	if obj.Pkg() != pg.pkg.Types {
+		pkgName := obj.Pkg().Name()
+		base = strings.ToUpper(pkgName[:1]) + pkgName[1:] + base
 	}
-	pg.types[id.Name] = toks
+	name := base
+	for i := 2; pg.helperNameTaken(name); i++ {
+		name = base + strconv.Itoa(i)
+	}
+
+	// Registered before generating, as the type will refer back to it
+	helper := &helperFunc{Type: named, Encoder: "bencodeWrite" + name, Decoder: "bencodeRead" + name}
+	if pg.helpers == nil {
+		pg.helpers = make(map[*types.TypeName]*helperFunc)
+	}
+	pg.helpers[obj] = helper
+
+	log.Debugf("Generating helpers for recursive type %v", named)
+	selector := receiverSelector(named)
+	path := pg.typeString(named)
+	ctx := typeContext{Path: path}
+	helper.encoder = tokens.MergeConsts(pg.typeTokens(selector, named, &ctx))
+	helper.uses = ctx.uses
+	if len(ctx.NoDecode) != 0 {
+		// Anything calling the helper contains the same type, so won't be decoded either
+		helper.Decoder = ""
+		return helper
+	}
+	helper.decoder = pg.typeTokens(selector, named, &typeContext{Path: path})
+	return helper
+}
+
+// dropUndecodable removes the decoders of types which call the ReadFrom method of a type without one
+// Types may call each other, so this is repeated until nothing changes
+func dropUndecodable(generated map[*types.TypeName]*PackageGenerator, pkgGens []*PackageGenerator) {
+	hasDecoder := func(obj *types.TypeName) bool {
+		_, ok := generated[obj].decoders[obj.Name()]
+		return ok
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for obj, pg := range generated {
+			if !hasDecoder(obj) {
+				continue
+			}
+			for _, used := range pg.uses[obj.Name()] {
+				if !hasDecoder(used) {
+					log.Warnf("Not generating a decoder for %v: %v has no decoder", obj.Name(), used.Name())
+					delete(pg.decoders, obj.Name())
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	// Helpers only call generated types, so can be resolved afterwards
+	for _, pg := range pkgGens {
+		for _, helper := range pg.helpers {
+			for _, used := range helper.uses {
+				if !hasDecoder(used) {
+					helper.Decoder = ""
+					break
+				}
+			}
+		}
+	}
+}
+
+// receiverSelector returns the selector for a value which is accessed through the pointer x
+// Pointers to structs only dereference themselves for field access
+func receiverSelector(typ types.Type) string {
+	if _, ok := typ.Underlying().(*types.Struct); ok {
+		return "x"
+	}
+	return "(*x)"
 }
 
 func (pg *PackageGenerator) writePackage(w io.Writer) {
@@ -219,9 +411,9 @@ func (pg *PackageGenerator) writePackage(w io.Writer) {
 	for _, k := range typeNames {
 		// Function declaration
 		fn := genFile.Func().
-			Parens(jen.Id("x").Op("*").Id(k)).
+			Parens(jen.Id("x").Op("*").Add(pg.receiverType(k))).
 			Id("WriteTo").
-			Params(jen.Id("w").Qual("github.com/predakanga/bencode_gen/pkg", "Writer")).
+			Params(jen.Id("w").Qual(pkgPath, "Writer")).
 			Parens(jen.Err().Error())
 		// Render the actual syntax tree
 		fn.BlockFunc(func(g *jen.Group) {
@@ -232,9 +424,81 @@ func (pg *PackageGenerator) writePackage(w io.Writer) {
 			g.Return()
 		})
 		genFile.Line()
+
+		decoder, ok := pg.decoders[k]
+		if !ok {
+			continue
+		}
+		genFile.Func().
+			Parens(jen.Id("x").Op("*").Add(pg.receiverType(k))).
+			Id("ReadFrom").
+			Params(jen.Id("r").Qual(pkgPath, "Reader")).
+			Parens(jen.Err().Error()).
+			BlockFunc(func(g *jen.Group) {
+				for _, tok := range decoder {
+					tok.GenerateDecodeAST(g)
+				}
+				g.Line()
+				g.Return()
+			})
+		genFile.Line()
+	}
+
+	// Followed by the helpers for any recursive types
+	helpers := make([]*helperFunc, 0, len(pg.helpers))
+	for _, helper := range pg.helpers {
+		helpers = append(helpers, helper)
+	}
+	sort.Slice(helpers, func(i, j int) bool {
+		return helpers[i].Encoder < helpers[j].Encoder
+	})
+
+	for _, helper := range helpers {
+		genFile.Func().
+			Id(helper.Encoder).
+			Params(jen.Id("w").Qual(pkgPath, "Writer"), jen.Id("x").Op("*").Add(tokens.TypeCode(helper.Type))).
+			Parens(jen.Err().Error()).
+			BlockFunc(func(g *jen.Group) {
+				for _, tok := range helper.encoder {
+					tok.GenerateAST(g)
+				}
+				g.Line()
+				g.Return()
+			})
+		genFile.Line()
+
+		if helper.Decoder == "" {
+			continue
+		}
+		genFile.Func().
+			Id(helper.Decoder).
+			Params(jen.Id("r").Qual(pkgPath, "Reader"), jen.Id("x").Op("*").Add(tokens.TypeCode(helper.Type))).
+			Parens(jen.Err().Error()).
+			BlockFunc(func(g *jen.Group) {
+				for _, tok := range helper.decoder {
+					tok.GenerateDecodeAST(g)
+				}
+				g.Line()
+				g.Return()
+			})
+		genFile.Line()
 	}
 
 	if err := genFile.Render(w); err != nil {
 		log.Fatalf("Failed to render syntax tree: %v", err)
 	}
 }
+
+// receiverType renders a type for use as a method receiver, such as Response[T] for generic types
+func (pg *PackageGenerator) receiverType(name string) *jen.Statement {
+	code := jen.Id(name)
+	named, ok := pg.pkg.Types.Scope().Lookup(name).Type().(*types.Named)
+	if !ok || named.TypeParams().Len() == 0 {
+		return code
+	}
+	return code.Index(jen.ListFunc(func(g *jen.Group) {
+		for i := 0; i < named.TypeParams().Len(); i++ {
+			g.Id(named.TypeParams().At(i).Obj().Name())
+		}
+	}))
+}
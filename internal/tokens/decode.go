@@ -0,0 +1,669 @@
+package tokens
+
+import (
+	"github.com/dave/jennifer/jen"
+	"go/types"
+)
+
+const pkgPath = "github.com/predakanga/bencode_gen/pkg"
+
+// Consts only frame the encoded output; each value token consumes its own delimiters when decoding
+func (c *Const) GenerateDecodeAST(g *jen.Group) {}
+
+/*
+	{
+		var tmp int64
+		if tmp, err = pkg.ReadInt(r, {{.Size}}); err != nil {
+			return
+		}
+		{{.}} = {{.Type}}(tmp)
+	}
+*/
+func (tok *Int) GenerateDecodeAST(g *jen.Group) {
+	decodeValue(g, tok.Data, tok.Type, types.Typ[types.Int64],
+		jen.Qual(pkgPath, "ReadInt").Call(jen.Id("r"), jen.Lit(bitSize(tok.Type))),
+		func(tmp jen.Code) jen.Code {
+			return TypeCode(tok.Type).Parens(tmp)
+		})
+}
+
+/*
+	{
+		var tmp uint64
+		if tmp, err = pkg.ReadUint(r, {{.Size}}); err != nil {
+			return
+		}
+		{{.}} = {{.Type}}(tmp)
+	}
+*/
+func (tok *Uint) GenerateDecodeAST(g *jen.Group) {
+	decodeValue(g, tok.Data, tok.Type, types.Typ[types.Uint64],
+		jen.Qual(pkgPath, "ReadUint").Call(jen.Id("r"), jen.Lit(bitSize(tok.Type))),
+		func(tmp jen.Code) jen.Code {
+			return TypeCode(tok.Type).Parens(tmp)
+		})
+}
+
+/*
+	if {{.}}, err = pkg.ReadDuration(r, time.{{.Unit}}); err != nil {
+		return
+	}
+*/
+func (tok *Duration) GenerateDecodeAST(g *jen.Group) {
+	g.If(
+		jen.List(jen.Id(tok.Data), jen.Err()).Op("=").Qual(pkgPath, "ReadDuration").Call(jen.Id("r"), jen.Qual("time", tok.Unit)),
+		jen.Err().Op("!=").Nil(),
+	).Block(jen.Return())
+}
+
+/*
+	{
+		{{ if .Scale }}
+		var tmp int64
+		if tmp, err = pkg.ReadInt(r, 64); err != nil {
+			return
+		}
+		{{.}} = {{.Type}}(float64(tmp) / {{.Scale}})
+		{{ else }}
+		var tmp float64
+		if tmp, err = pkg.ReadFloat(r, {{.Size}}); err != nil {
+			return
+		}
+		{{.}} = {{.Type}}(tmp)
+		{{ end }}
+	}
+*/
+func (tok *Float) GenerateDecodeAST(g *jen.Group) {
+	if tok.Scale != "" {
+		decodeValue(g, tok.Data, nil, types.Typ[types.Int64],
+			jen.Qual(pkgPath, "ReadInt").Call(jen.Id("r"), jen.Lit(64)),
+			func(tmp jen.Code) jen.Code {
+				return TypeCode(tok.Type).Parens(jen.Float64().Parens(tmp).Op("/").Id(tok.Scale))
+			})
+		return
+	}
+
+	decodeValue(g, tok.Data, tok.Type, types.Typ[types.Float64],
+		jen.Qual(pkgPath, "ReadFloat").Call(jen.Id("r"), jen.Lit(floatSize(tok.Type))),
+		func(tmp jen.Code) jen.Code {
+			return TypeCode(tok.Type).Parens(tmp)
+		})
+}
+
+/*
+	{
+		{{ if eq .Format TimeRFC3339 }}
+		var tmp string
+		if tmp, err = pkg.ReadString(r); err != nil {
+			return
+		}
+		if {{.}}, err = time.Parse(time.RFC3339, tmp); err != nil {
+			return
+		}
+		{{ else }}
+		var tmp int64
+		if tmp, err = pkg.ReadInt(r, 64); err != nil {
+			return
+		}
+		{{.}} = time.Unix({{ if eq .Format TimeUnixMillis }}tmp/1000, tmp%1000*1000000{{ else }}tmp, 0{{ end }}).UTC()
+		{{ end }}
+	}
+*/
+func (tok *Time) GenerateDecodeAST(g *jen.Group) {
+	if tok.Format == TimeRFC3339 {
+		g.Block(
+			jen.Var().Id("tmp").String(),
+			jen.If(
+				jen.List(jen.Id("tmp"), jen.Err()).Op("=").Qual(pkgPath, "ReadString").Call(jen.Id("r")),
+				jen.Err().Op("!=").Nil(),
+			).Block(jen.Return()),
+			jen.If(
+				jen.List(jen.Id(tok.Data), jen.Err()).Op("=").Qual("time", "Parse").Call(jen.Qual("time", "RFC3339"), jen.Id("tmp")),
+				jen.Err().Op("!=").Nil(),
+			).Block(jen.Return()),
+		)
+		return
+	}
+
+	decodeValue(g, tok.Data, nil, types.Typ[types.Int64],
+		jen.Qual(pkgPath, "ReadInt").Call(jen.Id("r"), jen.Lit(64)),
+		func(tmp jen.Code) jen.Code {
+			args := []jen.Code{tmp, jen.Lit(0)}
+			if tok.Format == TimeUnixMillis {
+				args = []jen.Code{jen.Add(tmp).Op("/").Lit(1000), jen.Add(tmp).Op("%").Lit(1000).Op("*").Lit(1000000)}
+			}
+			return jen.Qual("time", "Unix").Call(args...).Dot("UTC").Call()
+		})
+}
+
+/*
+	{{ if eq .Kind CompactUDPAddr }}
+	{
+		var tmp netip.AddrPort
+		if tmp, err = pkg.ReadCompactAddr(r, pkg.{{.Family}}); err != nil {
+			return
+		}
+		{{.}} = *net.UDPAddrFromAddrPort(tmp)
+	}
+	{{ else }}
+	if {{.}}, err = pkg.ReadCompactAddr{{ if eq .Kind CompactAddrPorts }}s{{ end }}(r, pkg.{{.Family}}); err != nil {
+		return
+	}
+	{{ end }}
+*/
+func (tok *Compact) GenerateDecodeAST(g *jen.Group) {
+	switch tok.Kind {
+	case CompactUDPAddr:
+		g.Block(
+			jen.Var().Id("tmp").Qual("net/netip", "AddrPort"),
+			jen.If(
+				jen.List(jen.Id("tmp"), jen.Err()).Op("=").Qual(pkgPath, "ReadCompactAddr").Call(jen.Id("r"), jen.Qual(pkgPath, tok.Family)),
+				jen.Err().Op("!=").Nil(),
+			).Block(jen.Return()),
+			jen.Id(tok.Data).Op("=").Op("*").Qual("net", "UDPAddrFromAddrPort").Call(jen.Id("tmp")),
+		)
+	case CompactAddrPorts:
+		g.If(
+			jen.List(jen.Id(tok.Data), jen.Err()).Op("=").Qual(pkgPath, "ReadCompactAddrs").Call(jen.Id("r"), jen.Qual(pkgPath, tok.Family)),
+			jen.Err().Op("!=").Nil(),
+		).Block(jen.Return())
+	default:
+		g.If(
+			jen.List(jen.Id(tok.Data), jen.Err()).Op("=").Qual(pkgPath, "ReadCompactAddr").Call(jen.Id("r"), jen.Qual(pkgPath, tok.Family)),
+			jen.Err().Op("!=").Nil(),
+		).Block(jen.Return())
+	}
+}
+
+/*
+	if err = pkg.ReadBigInt(r, &{{.}}); err != nil {
+		return
+	}
+*/
+func (tok *BigInt) GenerateDecodeAST(g *jen.Group) {
+	g.If(
+		jen.Err().Op("=").Qual(pkgPath, "ReadBigInt").Call(jen.Id("r"), jen.Op("&").Id(tok.Data)),
+		jen.Err().Op("!=").Nil(),
+	).Block(jen.Return())
+}
+
+/*
+	{
+		var tmp int64
+		if tmp, err = pkg.ReadInt(r, 64); err != nil {
+			return
+		}
+		{{.}} = tmp != 0
+	}
+*/
+func (tok *Bool) GenerateDecodeAST(g *jen.Group) {
+	decodeValue(g, tok.Data, tok.Type, types.Typ[types.Int64],
+		jen.Qual(pkgPath, "ReadInt").Call(jen.Id("r"), jen.Lit(64)),
+		func(tmp jen.Code) jen.Code {
+			cond := jen.Add(tmp).Op("!=").Lit(0)
+			if _, ok := tok.Type.(*types.Basic); ok {
+				return cond
+			}
+			return TypeCode(tok.Type).Parens(cond)
+		})
+}
+
+/*
+	if {{.}}, err = pkg.ReadString(r); err != nil {
+		return
+	}
+*/
+func (tok *String) GenerateDecodeAST(g *jen.Group) {
+	convert := func(tmp jen.Code) jen.Code {
+		return TypeCode(tok.Type).Parens(tmp)
+	}
+
+	switch tok.Type.Underlying().(type) {
+	case *types.Slice:
+		decodeValue(g, tok.Data, tok.Type, types.NewSlice(types.Typ[types.Byte]),
+			jen.Qual(pkgPath, "ReadBytes").Call(jen.Id("r")), convert)
+	case *types.Array:
+		// Arrays must be filled exactly, so are read in place
+		g.If(
+			jen.Err().Op("=").Qual(pkgPath, "ReadFixedBytes").Call(jen.Id("r"), jen.Id(tok.Data).Index(jen.Empty(), jen.Empty())),
+			jen.Err().Op("!=").Nil(),
+		).Block(jen.Return())
+	default:
+		decodeValue(g, tok.Data, tok.Type, types.Typ[types.String],
+			jen.Qual(pkgPath, "ReadString").Call(jen.Id("r")), convert)
+	}
+}
+
+/*
+	if err = {{.}}.ReadFrom(r); err != nil {
+		return
+	}
+*/
+func (tok *Native) GenerateDecodeAST(g *jen.Group) {
+	g.If(
+		jen.Err().Op("=").Id(tok.Data).Dot("ReadFrom").Call(jen.Id("r")),
+		jen.Err().Op("!=").Nil(),
+	).Block(jen.Return())
+}
+
+/*
+	{
+		var tmp []byte
+		if tmp, err = pkg.ReadBytes(r); err != nil {
+			return
+		}
+		if err = {{.}}.Unmarshal{{ if .Text }}Text{{ else }}Binary{{ end }}(tmp); err != nil {
+			return
+		}
+	}
+*/
+func (tok *Marshaler) GenerateDecodeAST(g *jen.Group) {
+	g.Block(
+		jen.Var().Id("tmp").Index().Byte(),
+		jen.If(
+			jen.List(jen.Id("tmp"), jen.Err()).Op("=").Qual(pkgPath, "ReadBytes").Call(jen.Id("r")),
+			jen.Err().Op("!=").Nil(),
+		).Block(jen.Return()),
+		jen.If(
+			jen.Err().Op("=").Id(tok.Data).Dot(tok.method("Unmarshal")).Call(jen.Id("tmp")),
+			jen.Err().Op("!=").Nil(),
+		).Block(jen.Return()),
+	)
+}
+
+/*
+	{{ if .Type is a type parameter }}
+	if err = pkg.ReadInto(r, &{{.}}); err != nil {
+		return
+	}
+	{{ else }}
+	if {{.}}, err = pkg.ReadValue(r); err != nil {
+		return
+	}
+	{{ end }}
+*/
+func (tok *Dynamic) GenerateDecodeAST(g *jen.Group) {
+	if _, ok := tok.Type.(*types.TypeParam); ok {
+		g.If(
+			jen.Err().Op("=").Qual(pkgPath, "ReadInto").Call(jen.Id("r"), jen.Op("&").Id(tok.Data)),
+			jen.Err().Op("!=").Nil(),
+		).Block(jen.Return())
+		return
+	}
+
+	g.If(
+		jen.List(jen.Id(tok.Data), jen.Err()).Op("=").Qual(pkgPath, "ReadValue").Call(jen.Id("r")),
+		jen.Err().Op("!=").Nil(),
+	).Block(jen.Return())
+}
+
+/*
+	if err = pkg.Expect(r, 'l'); err != nil {
+		return
+	}
+	{{.Selector}} = {{.Selector}}[:0]
+	for {
+		{{ more }}
+		var {{.Var}} {{.Elem}}
+		{{ children }}
+		{{.Selector}} = append({{.Selector}}, {{.Var}})
+	}
+	if err = pkg.Expect(r, 'e'); err != nil {
+		return
+	}
+*/
+func (tok *List) GenerateDecodeAST(g *jen.Group) {
+	expect(g, 'l')
+	if tok.Array {
+		// Arrays are filled in place, and must be long enough for every element
+		g.Id(tok.Index).Op(":=").Lit(0)
+		g.For().BlockFunc(func(sg *jen.Group) {
+			breakUnlessMore(sg)
+			sg.If(jen.Id(tok.Index).Op(">=").Len(jen.Id(tok.Selector))).Block(
+				jen.Err().Op("=").Qual(pkgPath, "ErrArrayLength"),
+				jen.Return(),
+			)
+			sg.Var().Id(tok.Var).Add(TypeCode(tok.Elem))
+			for _, child := range tok.Children {
+				child.GenerateDecodeAST(sg)
+			}
+			sg.Id(tok.Selector).Index(jen.Id(tok.Index)).Op("=").Id(tok.Var)
+			sg.Id(tok.Index).Op("++")
+		})
+	} else {
+		g.Id(tok.Selector).Op("=").Id(tok.Selector).Index(jen.Empty(), jen.Lit(0))
+		g.For().BlockFunc(func(sg *jen.Group) {
+			breakUnlessMore(sg)
+			sg.Var().Id(tok.Var).Add(TypeCode(tok.Elem))
+			for _, child := range tok.Children {
+				child.GenerateDecodeAST(sg)
+			}
+			sg.Id(tok.Selector).Op("=").Append(jen.Id(tok.Selector), jen.Id(tok.Var))
+		})
+	}
+	expect(g, 'e')
+}
+
+/*
+	if err = pkg.Expect(r, 'd'); err != nil {
+		return
+	}
+	if {{.Selector}} == nil {
+		{{.Selector}} = make({{.Type}})
+	}
+	for {
+		{{ more }}
+		{{ decoded key }}
+		var {{.Var}} {{.Type.Elem}}
+		{{ children }}
+		{{.Selector}}[{{.KeyVar}}] = {{.Var}}
+	}
+	if err = pkg.Expect(r, 'e'); err != nil {
+		return
+	}
+*/
+func (tok *Map) GenerateDecodeAST(g *jen.Group) {
+	expect(g, 'd')
+	g.If(jen.Id(tok.Selector).Op("==").Nil()).Block(
+		jen.Id(tok.Selector).Op("=").Make(TypeCode(tok.Type)),
+	)
+	g.For().BlockFunc(func(sg *jen.Group) {
+		breakUnlessMore(sg)
+		tok.decodeKey(sg)
+		sg.Var().Id(tok.Var).Add(TypeCode(tok.Type.Elem()))
+		for _, child := range tok.Children {
+			child.GenerateDecodeAST(sg)
+		}
+		sg.Id(tok.Selector).Index(jen.Id(tok.KeyVar)).Op("=").Id(tok.Var)
+	})
+	expect(g, 'e')
+}
+
+// decodeKey reads the next dict key and declares KeyVar as the matching map key
+func (tok *Map) decodeKey(g *jen.Group) {
+	keyType := tok.Type.Key()
+	convert := func(tmp jen.Code) jen.Code {
+		return TypeCode(keyType).Parens(tmp)
+	}
+
+	// Integers and byte arrays are read straight from the reader, so that errors can be positioned
+	switch tok.KeyKind {
+	case KeyInt:
+		g.Var().Id(tok.KeyVar).Add(TypeCode(keyType))
+		decodeValue(g, tok.KeyVar, keyType, types.Typ[types.Int64],
+			jen.Qual(pkgPath, "ReadIntKey").Call(jen.Id("r"), jen.Lit(bitSize(keyType))), convert)
+		return
+	case KeyUint:
+		g.Var().Id(tok.KeyVar).Add(TypeCode(keyType))
+		decodeValue(g, tok.KeyVar, keyType, types.Typ[types.Uint64],
+			jen.Qual(pkgPath, "ReadUintKey").Call(jen.Id("r"), jen.Lit(bitSize(keyType))), convert)
+		return
+	case KeyBytes:
+		g.Var().Id(tok.KeyVar).Add(TypeCode(keyType))
+		g.If(
+			jen.Err().Op("=").Qual(pkgPath, "ReadFixedBytes").Call(jen.Id("r"), jen.Id(tok.KeyVar).Index(jen.Empty(), jen.Empty())),
+			jen.Err().Op("!=").Nil(),
+		).Block(jen.Return())
+		return
+	}
+
+	g.Var().Id(tok.Str).String()
+	for _, child := range tok.Key {
+		child.GenerateDecodeAST(g)
+	}
+	switch tok.KeyKind {
+	case KeyString:
+		if isNamed(keyType) {
+			g.Id(tok.KeyVar).Op(":=").Add(convert(jen.Id(tok.Str)))
+		} else {
+			g.Id(tok.KeyVar).Op(":=").Id(tok.Str)
+		}
+	case KeyText:
+		g.Var().Id(tok.KeyVar).Add(TypeCode(keyType))
+		g.If(
+			jen.Err().Op("=").Id(tok.KeyVar).Dot("UnmarshalText").Call(jen.Index().Byte().Parens(jen.Id(tok.Str))),
+			jen.Err().Op("!=").Nil(),
+		).Block(jen.Return())
+	default:
+		panic("undecodable map key kind")
+	}
+}
+
+/*
+	if {{.Selector}} == nil {
+		{{.Selector}} = new({{.Elem}})
+	}
+*/
+func (tok *Pointer) GenerateDecodeAST(g *jen.Group) {
+	g.If(jen.Id(tok.Selector).Op("==").Nil()).Block(
+		jen.Id(tok.Selector).Op("=").New(TypeCode(tok.Elem)),
+	)
+	for _, child := range tok.Children {
+		child.GenerateDecodeAST(g)
+	}
+}
+
+/*
+	{{ if .Decoder }}
+	if err = {{.Decoder}}(r, &{{.}}); err != nil {
+		return
+	}
+	{{ else }}
+	{{ children }}
+	{{ end }}
+*/
+func (tok *Custom) GenerateDecodeAST(g *jen.Group) {
+	if tok.Decoder == "" {
+		for _, child := range tok.Children {
+			child.GenerateDecodeAST(g)
+		}
+		return
+	}
+	g.If(
+		jen.Err().Op("=").Id(tok.Decoder).Call(jen.Id("r"), jen.Op("&").Id(tok.Data)),
+		jen.Err().Op("!=").Nil(),
+	).Block(jen.Return())
+}
+
+/*
+	if err = {{.Decoder}}(r, &{{.}}); err != nil {
+		return
+	}
+*/
+func (tok *Helper) GenerateDecodeAST(g *jen.Group) {
+	g.If(
+		jen.Err().Op("=").Id(tok.Decoder).Call(jen.Id("r"), jen.Op("&").Id(tok.Data)),
+		jen.Err().Op("!=").Nil(),
+	).Block(jen.Return())
+}
+
+/*
+	if {{.Selector}} == nil {
+		{{.Selector}} = new({{.Elem}})
+	}
+*/
+func (tok *Alloc) GenerateDecodeAST(g *jen.Group) {
+	g.If(jen.Id(tok.Selector).Op("==").Nil()).Block(
+		jen.Id(tok.Selector).Op("=").New(TypeCode(tok.Elem)),
+	)
+}
+
+/*
+	if err = pkg.Expect(r, 'd'); err != nil {
+		return
+	}
+	for {
+		{{ more }}
+		var key string
+		if key, err = pkg.ReadString(r); err != nil {
+			return
+		}
+		switch key {
+		case "{{.Key}}":
+			{{ children }}
+		default:
+			if err = pkg.Skip(r); err != nil {
+				return
+			}
+		}
+	}
+	if err = pkg.Expect(r, 'e'); err != nil {
+		return
+	}
+*/
+func (tok *Dict) GenerateDecodeAST(g *jen.Group) {
+	expect(g, 'd')
+	g.For().BlockFunc(func(sg *jen.Group) {
+		breakUnlessMore(sg)
+		sg.Var().Id("key").String()
+		sg.If(
+			jen.List(jen.Id("key"), jen.Err()).Op("=").Qual(pkgPath, "ReadString").Call(jen.Id("r")),
+			jen.Err().Op("!=").Nil(),
+		).Block(jen.Return())
+		sg.Switch(jen.Id("key")).BlockFunc(func(cases *jen.Group) {
+			for _, field := range collectFields(tok.Fields) {
+				cases.Case(jen.Lit(field.Key)).BlockFunc(field.GenerateDecodeAST)
+			}
+			cases.Default().Block(
+				jen.If(
+					jen.Err().Op("=").Qual(pkgPath, "Skip").Call(jen.Id("r")),
+					jen.Err().Op("!=").Nil(),
+				).Block(jen.Return()),
+			)
+		})
+	})
+	expect(g, 'e')
+}
+
+/*
+	if err = pkg.Expect(r, 'l'); err != nil {
+		return
+	}
+	{{ elems }}
+	for {
+		{{ more }}
+		if err = pkg.Skip(r); err != nil {
+			return
+		}
+	}
+	if err = pkg.Expect(r, 'e'); err != nil {
+		return
+	}
+*/
+func (tok *Tuple) GenerateDecodeAST(g *jen.Group) {
+	expect(g, 'l')
+	for _, elem := range tok.Elems {
+		elem.GenerateDecodeAST(g)
+	}
+	// Like unknown dict keys, any trailing elements are skipped
+	g.For().BlockFunc(func(sg *jen.Group) {
+		breakUnlessMore(sg)
+		sg.If(
+			jen.Err().Op("=").Qual(pkgPath, "Skip").Call(jen.Id("r")),
+			jen.Err().Op("!=").Nil(),
+		).Block(jen.Return())
+	})
+	expect(g, 'e')
+}
+
+func (tok *Field) GenerateDecodeAST(g *jen.Group) {
+	for _, child := range tok.Children {
+		child.GenerateDecodeAST(g)
+	}
+}
+
+// Fields are always accepted when decoding; OmitEmpty only affects the encoder
+func (tok *OmitEmpty) GenerateDecodeAST(g *jen.Group) {
+	for _, child := range tok.Children {
+		child.GenerateDecodeAST(g)
+	}
+}
+
+// decodeValue reads a value using call, which returns a resultType, and stores it in selector
+// If the selector's type differs, the result is passed through convert first
+func decodeValue(g *jen.Group, selector string, typ types.Type, resultType types.Type, call jen.Code, convert func(jen.Code) jen.Code) {
+	if typ != nil && types.Identical(typ, resultType) {
+		g.If(
+			jen.List(jen.Id(selector), jen.Err()).Op("=").Add(call),
+			jen.Err().Op("!=").Nil(),
+		).Block(jen.Return())
+		return
+	}
+
+	g.Block(
+		jen.Var().Id("tmp").Add(TypeCode(resultType)),
+		jen.If(
+			jen.List(jen.Id("tmp"), jen.Err()).Op("=").Add(call),
+			jen.Err().Op("!=").Nil(),
+		).Block(jen.Return()),
+		jen.Id(selector).Op("=").Add(convert(jen.Id("tmp"))),
+	)
+}
+
+/*
+	if err = pkg.Expect(r, '{{.}}'); err != nil {
+		return
+	}
+*/
+func expect(g *jen.Group, c rune) {
+	g.If(
+		jen.Err().Op("=").Qual(pkgPath, "Expect").Call(jen.Id("r"), jen.LitRune(c)),
+		jen.Err().Op("!=").Nil(),
+	).Block(jen.Return())
+}
+
+/*
+	var more bool
+	if more, err = pkg.More(r); err != nil {
+		return
+	}
+	if !more {
+		break
+	}
+*/
+func breakUnlessMore(g *jen.Group) {
+	g.Var().Id("more").Bool()
+	g.If(
+		jen.List(jen.Id("more"), jen.Err()).Op("=").Qual(pkgPath, "More").Call(jen.Id("r")),
+		jen.Err().Op("!=").Nil(),
+	).Block(jen.Return())
+	g.If(jen.Op("!").Id("more")).Block(jen.Break())
+}
+
+// collectFields finds the fields of a dict, looking through any wrapping containers
+func collectFields(tokens []CodeToken) (fields []*Field) {
+	for _, tok := range tokens {
+		switch castTok := tok.(type) {
+		case *Field:
+			fields = append(fields, castTok)
+		case Container:
+			fields = append(fields, collectFields(castTok.Contents())...)
+		}
+	}
+
+	return
+}
+
+// bitSize returns the size of an integer type, as understood by strconv.ParseInt and ParseUint
+func bitSize(typ types.Type) int {
+	if basic, ok := typ.Underlying().(*types.Basic); ok {
+		switch basic.Kind() {
+		case types.Int8, types.Uint8:
+			return 8
+		case types.Int16, types.Uint16:
+			return 16
+		case types.Int32, types.Uint32:
+			return 32
+		case types.Int64, types.Uint64:
+			return 64
+		}
+	}
+	return 0
+}
+
+func floatSize(typ types.Type) int {
+	if basic, ok := typ.Underlying().(*types.Basic); ok && basic.Kind() == types.Float32 {
+		return 32
+	}
+	return 64
+}
@@ -1,7 +1,9 @@
 package tokens
 
 import (
+	"fmt"
 	"github.com/dave/jennifer/jen"
+	"go/types"
 )
 
 /*
@@ -38,6 +40,170 @@ func (tok *Int) GenerateAST(g *jen.Group) {
 	)
 }
 
+/*
+	if _, err = w.WriteString(strconv.FormatUint(uint64({{.}}), 10)); err != nil {
+		return
+	}
+*/
+func (tok *Uint) GenerateAST(g *jen.Group) {
+	g.If(
+		jen.List(jen.Id("_"), jen.Err()).Op("=").Id("w").Dot("WriteString").Call(
+			jen.Qual("strconv", "FormatUint").Call(jen.Uint64().Parens(jen.Id(tok.Data)), jen.Lit(10)),
+		),
+		jen.Err().Op("!=").Nil(),
+	).Block(
+		jen.Return(),
+	)
+}
+
+/*
+	{{ if eq .Rounding "RoundTrunc" }}
+	if _, err = w.WriteString(strconv.FormatInt(int64({{.}} / time.{{.Unit}}), 10)); err != nil {
+		return
+	}
+	{{ else }}
+	if _, err = w.WriteString(strconv.FormatInt(pkg.DurationUnits({{.}}, time.{{.Unit}}, pkg.{{.Rounding}}), 10)); err != nil {
+		return
+	}
+	{{ end }}
+*/
+func (tok *Duration) GenerateAST(g *jen.Group) {
+	// Integer division truncates by itself, so only the other rounding modes need our help
+	var value *jen.Statement
+	if tok.Rounding == "RoundTrunc" {
+		value = jen.Int64().Parens(jen.Id(tok.Data).Op("/").Qual("time", tok.Unit))
+	} else {
+		value = jen.Qual(pkgPath, "DurationUnits").Call(jen.Id(tok.Data), jen.Qual("time", tok.Unit), jen.Qual(pkgPath, tok.Rounding))
+	}
+
+	g.If(
+		jen.List(jen.Id("_"), jen.Err()).Op("=").Id("w").Dot("WriteString").Call(
+			jen.Qual("strconv", "FormatInt").Call(value, jen.Lit(10)),
+		),
+		jen.Err().Op("!=").Nil(),
+	).Block(jen.Return())
+}
+
+/*
+	{{ if eq .Kind CompactAddrPorts }}
+	if err = pkg.WriteCompactAddrs(w, {{.}}, pkg.{{.Family}}); err != nil {
+		return
+	}
+	{{ else }}
+	if err = pkg.WriteCompactAddr(w, {{.}}{{ if eq .Kind CompactUDPAddr }}.AddrPort(){{ end }}, pkg.{{.Family}}); err != nil {
+		return
+	}
+	{{ end }}
+*/
+func (tok *Compact) GenerateAST(g *jen.Group) {
+	write, value := "WriteCompactAddr", jen.Id(tok.Data)
+	switch tok.Kind {
+	case CompactUDPAddr:
+		value = value.Dot("AddrPort").Call()
+	case CompactAddrPorts:
+		write = "WriteCompactAddrs"
+	}
+
+	g.If(
+		jen.Err().Op("=").Qual(pkgPath, write).Call(jen.Id("w"), value, jen.Qual(pkgPath, tok.Family)),
+		jen.Err().Op("!=").Nil(),
+	).Block(jen.Return())
+}
+
+/*
+	if _, err = w.WriteString({{.}}.Text(10)); err != nil {
+		return
+	}
+*/
+func (tok *BigInt) GenerateAST(g *jen.Group) {
+	g.If(
+		jen.List(jen.Id("_"), jen.Err()).Op("=").Id("w").Dot("WriteString").Call(
+			jen.Id(tok.Data).Dot("Text").Call(jen.Lit(10)),
+		),
+		jen.Err().Op("!=").Nil(),
+	).Block(
+		jen.Return(),
+	)
+}
+
+/*
+	{{ if .Scale }}
+	{
+		var tmp int64
+		if tmp, err = pkg.ScaleFloat(float64({{.}}), {{.Scale}}); err != nil {
+			return
+		}
+		if _, err = w.WriteString(strconv.FormatInt(tmp, 10)); err != nil {
+			return
+		}
+	}
+	{{ else }}
+	{
+		tmp := strconv.FormatFloat(float64({{.}}), 'f', -1, {{.Size}})
+		{{ String{tmp} }}
+	}
+	{{ end }}
+*/
+func (tok *Float) GenerateAST(g *jen.Group) {
+	value := jen.Float64().Parens(jen.Id(tok.Data))
+	if tok.Scale != "" {
+		// Scaling checks that the result fits, as converting NaN or huge floats to int64 is implementation-defined
+		g.Block(
+			jen.Var().Id("tmp").Int64(),
+			jen.If(
+				jen.List(jen.Id("tmp"), jen.Err()).Op("=").Qual(pkgPath, "ScaleFloat").Call(value, jen.Id(tok.Scale)),
+				jen.Err().Op("!=").Nil(),
+			).Block(jen.Return()),
+			jen.If(
+				jen.List(jen.Id("_"), jen.Err()).Op("=").Id("w").Dot("WriteString").Call(
+					jen.Qual("strconv", "FormatInt").Call(jen.Id("tmp"), jen.Lit(10)),
+				),
+				jen.Err().Op("!=").Nil(),
+			).Block(jen.Return()),
+		)
+		return
+	}
+
+	g.BlockFunc(func(sg *jen.Group) {
+		sg.Id("tmp").Op(":=").Qual("strconv", "FormatFloat").Call(value, jen.LitRune('f'), jen.Lit(-1), jen.Lit(floatSize(tok.Type)))
+		(&String{Data: "tmp", Type: types.Typ[types.String]}).GenerateAST(sg)
+	})
+}
+
+/*
+	{{ if eq .Format TimeRFC3339 }}
+	{
+		tmp := {{.}}.Format(time.RFC3339)
+		{{ String{tmp} }}
+	}
+	{{ else }}
+	if _, err = w.WriteString(strconv.FormatInt({{.}}.Unix(){{ if eq .Format TimeUnixMillis }}*1000 + int64({{.}}.Nanosecond()/1000000){{ end }}, 10)); err != nil {
+		return
+	}
+	{{ end }}
+*/
+func (tok *Time) GenerateAST(g *jen.Group) {
+	if tok.Format == TimeRFC3339 {
+		g.BlockFunc(func(sg *jen.Group) {
+			sg.Id("tmp").Op(":=").Id(tok.Data).Dot("Format").Call(jen.Qual("time", "RFC3339"))
+			(&String{Data: "tmp", Type: types.Typ[types.String]}).GenerateAST(sg)
+		})
+		return
+	}
+
+	value := jen.Id(tok.Data).Dot("Unix").Call()
+	if tok.Format == TimeUnixMillis {
+		// Avoid UnixNano, which overflows outside of the years 1678-2262
+		value = value.Op("*").Lit(1000).Op("+").Int64().Parens(jen.Id(tok.Data).Dot("Nanosecond").Call().Op("/").Lit(1000000))
+	}
+	g.If(
+		jen.List(jen.Id("_"), jen.Err()).Op("=").Id("w").Dot("WriteString").Call(
+			jen.Qual("strconv", "FormatInt").Call(value, jen.Lit(10)),
+		),
+		jen.Err().Op("!=").Nil(),
+	).Block(jen.Return())
+}
+
 /*
 	if {{.}} {
 		err = w.WriteByte('1')
@@ -69,6 +235,21 @@ func (tok *Bool) GenerateAST(g *jen.Group) {
 	}
 */
 func (tok *String) GenerateAST(g *jen.Group) {
+	// Byte slices and arrays are written as-is, while named string types need converting for WriteString
+	write := jen.Id("w").Dot("WriteString")
+	value := jen.Id(tok.Data)
+	switch underlying := tok.Type.Underlying().(type) {
+	case *types.Slice:
+		write = jen.Id("w").Dot("Write")
+	case *types.Array:
+		write = jen.Id("w").Dot("Write")
+		value = value.Index(jen.Empty(), jen.Empty())
+	default:
+		if underlying != tok.Type {
+			value = jen.String().Parens(value)
+		}
+	}
+
 	g.If(
 		jen.List(jen.Id("_"), jen.Err()).Op("=").Id("w").Dot("WriteString").Call(
 			jen.Qual("strconv", "Itoa").Call(jen.Len(jen.Id(tok.Data))),
@@ -80,7 +261,7 @@ func (tok *String) GenerateAST(g *jen.Group) {
 		jen.Err().Op("!=").Nil(),
 	).Block(jen.Return())
 	g.If(
-		jen.List(jen.Id("_"), jen.Err()).Op("=").Id("w").Dot("WriteString").Call(jen.Id(tok.Data)),
+		jen.List(jen.Id("_"), jen.Err()).Op("=").Add(write).Call(value),
 		jen.Err().Op("!=").Nil(),
 	).Block(jen.Return())
 }
@@ -97,8 +278,66 @@ func (tok *Native) GenerateAST(g *jen.Group) {
 	).Block(jen.Return())
 }
 
+/*
+	{
+		var tmp []byte
+		if tmp, err = {{.}}.Marshal{{ if .Text }}Text{{ else }}Binary{{ end }}(); err != nil {
+			return
+		}
+		{{ String{tmp} }}
+	}
+*/
+func (tok *Marshaler) GenerateAST(g *jen.Group) {
+	g.BlockFunc(func(sg *jen.Group) {
+		sg.Var().Id("tmp").Index().Byte()
+		sg.If(
+			jen.List(jen.Id("tmp"), jen.Err()).Op("=").Id(tok.Data).Dot(tok.method("Marshal")).Call(),
+			jen.Err().Op("!=").Nil(),
+		).Block(jen.Return())
+		(&String{Data: "tmp", Type: types.NewSlice(types.Typ[types.Byte])}).GenerateAST(sg)
+	})
+}
+
+// method returns the name of the marshaler's method with the given prefix, such as MarshalText
+func (tok *Marshaler) method(prefix string) string {
+	if tok.Text {
+		return prefix + "Text"
+	}
+	return prefix + "Binary"
+}
+
+/*
+	if err = pkg.WriteValue(w, {{ if .Type is a type parameter }}&{{ end }}{{.}}); err != nil {
+		return
+	}
+*/
+func (tok *Dynamic) GenerateAST(g *jen.Group) {
+	// Like ReadInto, type parameters are passed by pointer, so that methods with pointer receivers are found
+	value := jen.Id(tok.Data)
+	if _, ok := tok.Type.(*types.TypeParam); ok {
+		value = jen.Op("&").Id(tok.Data)
+	}
+	g.If(
+		jen.Err().Op("=").Qual(pkgPath, "WriteValue").Call(jen.Id("w"), value),
+		jen.Err().Op("!=").Nil(),
+	).Block(jen.Return())
+}
+
+/*
+	for _, {{.Var}} := range {{.Selector}} {
+		{{ if .SkipNil }}
+		if {{.Var}} == nil {
+			continue
+		}
+		{{ end }}
+		{{ children }}
+	}
+*/
 func (tok *List) GenerateAST(g *jen.Group) {
-	g.For(jen.Id("i").Op(":=").Range().Id(tok.Selector)).BlockFunc(func(sg *jen.Group) {
+	g.For(jen.List(jen.Id("_"), jen.Id(tok.Var)).Op(":=").Range().Id(tok.Selector)).BlockFunc(func(sg *jen.Group) {
+		if tok.SkipNil {
+			sg.If(jen.Id(tok.Var).Op("==").Nil()).Block(jen.Continue())
+		}
 		for _, child := range tok.Children {
 			child.GenerateAST(sg)
 		}
@@ -114,41 +353,87 @@ func (tok *List) SetContents(children []CodeToken) {
 }
 
 /*
-	mapKeys = nil
-	for k, _ := range {{.Selector}} {
-		mapKeys = append(mapKeys, {{ if (.Import) ne "" }}string(k){{ else }}k{{ end }})
+	{{.Keys}} := make([]string, 0, len({{.Selector}}))
+	{{ if .Lookup }}
+	{{.Lookup}} := make(map[string]{{.Type.Key}}, len({{.Selector}}))
+	{{ end }}
+	for {{.KeyVar}} := range {{.Selector}} {
+		{{ if .SkipNil }}
+		if {{.Selector}}[{{.KeyVar}}] == nil {
+			continue
+		}
+		{{ end }}
+		{{.Str}} := {{ encoded key }}
+		{{ if .Lookup }}
+		if _, ok := {{.Lookup}}[{{.Str}}]; ok {
+			err = &pkg.DuplicateKeyError{Key: {{.Str}}}
+			return
+		}
+		{{.Lookup}}[{{.Str}}] = {{.KeyVar}}
+		{{ end }}
+		{{.Keys}} = append({{.Keys}}, {{.Str}})
+	}
+	sort.Strings({{.Keys}})
+	for _, {{.Str}} := range {{.Keys}} {
+		{{ if .Lookup }}
+		{{.KeyVar}} := {{.Lookup}}[{{.Str}}]
+		{{ else if eq .KeyKind KeyBytes }}
+		var {{.KeyVar}} {{.Type.Key}}
+		copy({{.KeyVar}}[:], {{.Str}})
+		{{ else }}
+		{{.KeyVar}} := {{.Type.Key}}({{.Str}})
+		{{ end }}
+		{{.Var}} := {{.Selector}}[{{.KeyVar}}]
+		{{ key }}
+		{{ children }}
 	}
-	sort.Sort(mapKeys)
-	for _, idx := range mapKeys {
-	{{- if (.Import) ne "" }}
-		k := {{ .Import }}.{{ .Type }}(idx)
-	{{- else }}
-		k := idx
-	{{- end }}
  */
 func (tok *Map) GenerateAST(g *jen.Group) {
-	// First, sort the map
-	g.Id("mapKeys").Op("=").Nil()
+	// First, encode each key and sort them
+	g.Id(tok.Keys).Op(":=").Make(jen.Index().String(), jen.Lit(0), jen.Len(jen.Id(tok.Selector)))
+	if tok.Lookup != "" {
+		g.Id(tok.Lookup).Op(":=").Make(jen.Map(jen.String()).Add(TypeCode(tok.Type.Key())), jen.Len(jen.Id(tok.Selector)))
+	}
 	g.For(
-		jen.List(jen.Id("k"), jen.Id("_")).Op(":=").Range().Id(tok.Selector),
-	).Block(
-		jen.Id("mapKeys").Op("=").AppendFunc(func(sg *jen.Group) {
-			sg.Id("mapKeys")
-			if tok.Cast != nil {
-				sg.String().Parens(jen.Id("k"))
-			} else {
-				sg.Id("k")
-			}
-		}),
-	)
-	g.Qual("sort", "Sort").Call(jen.Id("mapKeys"))
+		jen.Id(tok.KeyVar).Op(":=").Range().Id(tok.Selector),
+	).BlockFunc(func(sg *jen.Group) {
+		// Skipped values are left out of the keys, so that their keys aren't written either
+		if tok.SkipNil {
+			sg.If(jen.Id(tok.Selector).Index(jen.Id(tok.KeyVar)).Op("==").Nil()).Block(jen.Continue())
+		}
+		tok.encodeKey(sg)
+		if tok.Lookup != "" {
+			// Distinct keys which encode identically would make for an invalid dict
+			sg.If(
+				jen.List(jen.Id("_"), jen.Id("ok")).Op(":=").Id(tok.Lookup).Index(jen.Id(tok.Str)),
+				jen.Id("ok"),
+			).Block(
+				jen.Err().Op("=").Op("&").Qual(pkgPath, "DuplicateKeyError").Values(jen.Dict{jen.Id("Key"): jen.Id(tok.Str)}),
+				jen.Return(),
+			)
+			sg.Id(tok.Lookup).Index(jen.Id(tok.Str)).Op("=").Id(tok.KeyVar)
+		}
+		sg.Id(tok.Keys).Op("=").Append(jen.Id(tok.Keys), jen.Id(tok.Str))
+	})
+	g.Qual("sort", "Strings").Call(jen.Id(tok.Keys))
+
+	// Then write the entries in order
 	g.For(
-		jen.List(jen.Id("_"), jen.Id("idx")).Op(":=").Range().Id("mapKeys"),
+		jen.List(jen.Id("_"), jen.Id(tok.Str)).Op(":=").Range().Id(tok.Keys),
 	).BlockFunc(func(sg *jen.Group) {
-		if tok.Cast != nil {
-			sg.Id("k").Op(":=").Qual(tok.Cast.Pkg().Path(), tok.Cast.Name()).Parens(jen.Id("idx"))
+		if tok.Lookup != "" {
+			sg.Id(tok.KeyVar).Op(":=").Id(tok.Lookup).Index(jen.Id(tok.Str))
+		} else if tok.KeyKind == KeyBytes {
+			sg.Var().Id(tok.KeyVar).Add(TypeCode(tok.Type.Key()))
+			sg.Copy(jen.Id(tok.KeyVar).Index(jen.Empty(), jen.Empty()), jen.Id(tok.Str))
+		} else if isNamed(tok.Type.Key()) {
+			sg.Id(tok.KeyVar).Op(":=").Add(TypeCode(tok.Type.Key())).Parens(jen.Id(tok.Str))
 		} else {
-			sg.Id("k").Op(":=").Id("idx")
+			sg.Id(tok.KeyVar).Op(":=").Id(tok.Str)
+		}
+		sg.Id(tok.Var).Op(":=").Id(tok.Selector).Index(jen.Id(tok.KeyVar))
+		for _, child := range tok.Key {
+			child.GenerateAST(sg)
 		}
 		for _, child := range tok.Children {
 			child.GenerateAST(sg)
@@ -156,6 +441,33 @@ func (tok *Map) GenerateAST(g *jen.Group) {
 	})
 }
 
+// encodeKey declares Str as the dict key for KeyVar
+func (tok *Map) encodeKey(g *jen.Group) {
+	key := jen.Id(tok.KeyVar)
+	switch tok.KeyKind {
+	case KeyString:
+		if isNamed(tok.Type.Key()) {
+			key = jen.String().Parens(key)
+		}
+	case KeyText:
+		g.Var().Id("tmp").Index().Byte()
+		g.If(
+			jen.List(jen.Id("tmp"), jen.Err()).Op("=").Id(tok.KeyVar).Dot("MarshalText").Call(),
+			jen.Err().Op("!=").Nil(),
+		).Block(jen.Return())
+		key = jen.String().Parens(jen.Id("tmp"))
+	case KeyStringer:
+		key = key.Dot("String").Call()
+	case KeyInt:
+		key = jen.Qual("strconv", "FormatInt").Call(jen.Int64().Parens(key), jen.Lit(10))
+	case KeyUint:
+		key = jen.Qual("strconv", "FormatUint").Call(jen.Uint64().Parens(key), jen.Lit(10))
+	case KeyBytes:
+		key = jen.String().Parens(key.Index(jen.Empty(), jen.Empty()))
+	}
+	g.Id(tok.Str).Op(":=").Add(key)
+}
+
 func (tok *Map) Contents() []CodeToken {
 	return tok.Children
 }
@@ -175,6 +487,8 @@ func (tok *OmitEmpty) GenerateAST(g *jen.Group) {
 			cond.Id(tok.Selector).Op("!=").Nil()
 		case "false":
 			cond.Id(tok.Selector).Op("!=").False()
+		case "IsZero":
+			cond.Op("!").Id(tok.Selector).Dot("IsZero").Call()
 		}
 	}).BlockFunc(func(sg *jen.Group) {
 		for _, child := range tok.Children {
@@ -191,6 +505,135 @@ func (tok *OmitEmpty) SetContents(children []CodeToken) {
 	tok.Children = children
 }
 
-func (tok *MapSort) GenerateAST(g *jen.Group) {
-	g.Var().Id("mapKeys").Qual("sort", "StringSlice").Line()
-}
\ No newline at end of file
+/*
+	{{ if eq .Nil NilError }}
+	if {{.Selector}} == nil {
+		err = &pkg.NilPointerError{Path: "{{.Path}}"}
+		return
+	}
+	{{ children }}
+	{{ else if eq .Nil NilEmpty }}
+	if {{.Selector}} == nil {
+		var {{.Zero}} {{.Elem}}
+		{{ empty }}
+	} else {
+		{{ children }}
+	}
+	{{ else }}
+	{{ children }}
+	{{ end }}
+*/
+func (tok *Pointer) GenerateAST(g *jen.Group) {
+	// Children dereference the pointer themselves, so only the nil case needs handling here
+	switch tok.Nil {
+	case NilError:
+		g.If(jen.Id(tok.Selector).Op("==").Nil()).Block(
+			jen.Err().Op("=").Op("&").Qual(pkgPath, "NilPointerError").Values(jen.Dict{jen.Id("Path"): jen.Lit(tok.Path)}),
+			jen.Return(),
+		)
+	case NilEmpty:
+		g.If(jen.Id(tok.Selector).Op("==").Nil()).BlockFunc(func(sg *jen.Group) {
+			sg.Var().Id(tok.Zero).Add(TypeCode(tok.Elem))
+			for _, child := range tok.Empty {
+				child.GenerateAST(sg)
+			}
+		}).Else().BlockFunc(func(sg *jen.Group) {
+			for _, child := range tok.Children {
+				child.GenerateAST(sg)
+			}
+		})
+		return
+	}
+
+	for _, child := range tok.Children {
+		child.GenerateAST(g)
+	}
+}
+
+func (tok *Pointer) Contents() []CodeToken {
+	return tok.Children
+}
+
+func (tok *Pointer) SetContents(children []CodeToken) {
+	tok.Children = children
+}
+
+/*
+	{{ if .Encoder }}
+	if err = {{.Encoder}}(w, {{.}}); err != nil {
+		return
+	}
+	{{ else }}
+	{{ children }}
+	{{ end }}
+*/
+func (tok *Custom) GenerateAST(g *jen.Group) {
+	if tok.Encoder == "" {
+		for _, child := range tok.Children {
+			child.GenerateAST(g)
+		}
+		return
+	}
+	g.If(
+		jen.Err().Op("=").Id(tok.Encoder).Call(jen.Id("w"), jen.Id(tok.Data)),
+		jen.Err().Op("!=").Nil(),
+	).Block(jen.Return())
+}
+
+func (tok *Custom) Contents() []CodeToken {
+	return tok.Children
+}
+
+func (tok *Custom) SetContents(children []CodeToken) {
+	tok.Children = children
+}
+
+/*
+	if err = {{.Encoder}}(w, &{{.}}); err != nil {
+		return
+	}
+*/
+func (tok *Helper) GenerateAST(g *jen.Group) {
+	g.If(
+		jen.Err().Op("=").Id(tok.Encoder).Call(jen.Id("w"), jen.Op("&").Id(tok.Data)),
+		jen.Err().Op("!=").Nil(),
+	).Block(jen.Return())
+}
+
+func (tok *Alloc) GenerateAST(g *jen.Group) {}
+
+// Allocs are only needed to decode, so they disappear from the encoder
+func (tok *Alloc) Inline() []CodeToken {
+	return nil
+}
+
+func (tok *Dict) GenerateAST(g *jen.Group) {
+	for _, child := range tok.Inline() {
+		child.GenerateAST(g)
+	}
+}
+
+func (tok *Dict) Inline() []CodeToken {
+	return tok.Fields
+}
+
+func (tok *Tuple) GenerateAST(g *jen.Group) {
+	for _, child := range tok.Inline() {
+		child.GenerateAST(g)
+	}
+}
+
+func (tok *Tuple) Inline() []CodeToken {
+	return tok.Elems
+}
+
+func (tok *Field) GenerateAST(g *jen.Group) {
+	for _, child := range tok.Inline() {
+		child.GenerateAST(g)
+	}
+}
+
+func (tok *Field) Inline() []CodeToken {
+	key := &Const{Data: fmt.Sprintf("%d:%s", len(tok.Key), tok.Key)}
+	return append([]CodeToken{key}, tok.Children...)
+}
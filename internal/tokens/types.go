@@ -7,6 +7,7 @@ import (
 
 type CodeToken interface {
 	GenerateAST(g *jen.Group)
+	GenerateDecodeAST(g *jen.Group)
 }
 
 type Container interface {
@@ -14,28 +15,165 @@ type Container interface {
 	Contents() []CodeToken
 }
 
+// Inliner is implemented by tokens which encode as a plain sequence of other tokens
+type Inliner interface {
+	Inline() []CodeToken
+}
+
 type leafToken struct{
 	Data string
 }
 
-type MapSort struct{}
+// valueTokens need their type to be able to decode into Data
+type valueToken struct{
+	Data string
+	Type types.Type
+}
+
 type Const leafToken
-type Int leafToken
-type Bool leafToken
-type String leafToken
+type Int valueToken
+type Uint valueToken
+type Bool valueToken
+type String valueToken
 type Native leafToken
+// Dynamic values are interfaces, whose concrete type is only known at runtime
+type Dynamic valueToken
+type BigInt leafToken
+
+// KeyKind determines how map keys are converted to and from dict keys
+type KeyKind int
+
+const (
+	KeyString KeyKind = iota
+	KeyText
+	KeyStringer
+	KeyInt
+	KeyUint
+	KeyBytes
+)
+
+// NilMode determines what is written in place of a nil pointer
+type NilMode int
+
+const (
+	NilError NilMode = iota
+	NilEmpty
+	// NilOmit leaves the skipping to the enclosing field, list or map
+	NilOmit
+)
 
+// Var and the other identifiers are allocated per generated function, so that nested containers can't clash
 type List struct{
 	Selector string
+	Var      string
+	Index    string
+	Elem     types.Type
+	Array    bool
+	SkipNil  bool
 	Children []CodeToken
 }
+// Lookup is only used for keys which can't be converted back from their encoded form
 type Map struct{
 	Selector string
-	Cast     *types.TypeName
+	Type     *types.Map
+	KeyKind  KeyKind
+	Keys     string
+	Lookup   string
+	Str      string
+	KeyVar   string
+	Var      string
+	SkipNil  bool
+	Key      []CodeToken
+	Children []CodeToken
+}
+// Floats are written as decimal strings, unless they have a Scale to multiply by before rounding
+type Float struct{
+	Data  string
+	Type  types.Type
+	Scale string
+}
+// Unit is the name of a time.Duration constant, and Rounding the name of a pkg.Rounding constant
+type Duration struct{
+	Data     string
+	Unit     string
+	Rounding string
+}
+
+type TimeFormat int
+
+const (
+	TimeUnix TimeFormat = iota
+	TimeUnixMillis
+	TimeRFC3339
+)
+
+type Time struct{
+	Data   string
+	Format TimeFormat
+}
+
+// Marshalers are written as strings using MarshalBinary, or MarshalText if Text is set
+type Marshaler struct{
+	Data string
+	Text bool
+}
+
+// CompactKind is the type being packed into a compact address string
+type CompactKind int
+
+const (
+	CompactAddrPort CompactKind = iota
+	CompactUDPAddr
+	CompactAddrPorts
+)
+
+// Family is the name of a pkg.Compact constant
+type Compact struct{
+	Data   string
+	Kind   CompactKind
+	Family string
+}
+// Empty encodes Zero, a variable of the Elem type, and is only used by NilEmpty
+type Pointer struct{
+	Selector string
+	Elem     types.Type
+	Nil      NilMode
+	Path     string
+	Zero     string
+	Empty    []CodeToken
+	Children []CodeToken
+}
+// Custom fields call user functions to encode and decode, falling back to Children for either that's missing
+type Custom struct{
+	Data     string
+	Encoder  string
+	Decoder  string
+	Children []CodeToken
+}
+// Helper calls the generated functions for a recursive type, passing them a pointer to Data
+type Helper struct{
+	Data    string
+	Encoder string
+	Decoder string
+}
+// Alloc makes sure a pointer is allocated before decoding through it, such as an embedded pointer's promoted fields
+type Alloc struct{
+	Selector string
+	Elem     types.Type
+}
+type Dict struct{
+	Fields []CodeToken
+}
+// Tuples are structs encoded as lists, so their Elems are the values of each field in turn
+type Tuple struct{
+	Elems []CodeToken
+}
+type Field struct{
+	Key      string
 	Children []CodeToken
 }
 type OmitEmpty struct{
 	Selector    string
 	EmptyMethod string
 	Children    []CodeToken
-}
\ No newline at end of file
+}
@@ -1,13 +1,15 @@
 package tokens
 
+import (
+	"github.com/dave/jennifer/jen"
+	"go/types"
+)
+
 // We can only merge consts in containers
 func MergeConsts(tokens []CodeToken) (toRet []CodeToken) {
-	childCount := len(tokens)
-	if childCount < 2 {
-		return tokens
-	}
-
-	toRet = make([]CodeToken, 0, childCount)
+	tokens = inline(tokens)
+	// Even a lone token may be a container with consts of its own
+	toRet = make([]CodeToken, 0, len(tokens))
 	buffer := ""
 
 	for _, tok := range tokens {
@@ -33,3 +35,76 @@ func MergeConsts(tokens []CodeToken) (toRet []CodeToken) {
 
 	return
 }
+
+// Splice in the contents of any inliners, so that their consts can be merged
+func inline(tokens []CodeToken) (toRet []CodeToken) {
+	for _, tok := range tokens {
+		if inliner, ok := tok.(Inliner); ok {
+			toRet = append(toRet, inline(inliner.Inline())...)
+		} else {
+			toRet = append(toRet, tok)
+		}
+	}
+
+	return
+}
+
+func isNamed(typ types.Type) bool {
+	_, ok := typ.(*types.Named)
+	return ok
+}
+
+// TypeCode renders a type reference, qualifying named types with their package
+func TypeCode(typ types.Type) *jen.Statement {
+	switch castType := typ.(type) {
+	case *types.Named:
+		obj := castType.Obj()
+		if obj.Pkg() == nil {
+			// Universe types, such as error
+			return jen.Id(obj.Name())
+		}
+		code := jen.Qual(obj.Pkg().Path(), obj.Name())
+		if args := castType.TypeArgs(); args.Len() != 0 {
+			code.Index(jen.ListFunc(func(g *jen.Group) {
+				for i := 0; i < args.Len(); i++ {
+					g.Add(TypeCode(args.At(i)))
+				}
+			}))
+		}
+		return code
+	case *types.TypeParam:
+		return jen.Id(castType.Obj().Name())
+	case *types.Basic:
+		return jen.Id(castType.Name())
+	case *types.Pointer:
+		return jen.Op("*").Add(TypeCode(castType.Elem()))
+	case *types.Slice:
+		return jen.Index().Add(TypeCode(castType.Elem()))
+	case *types.Array:
+		return jen.Index(jen.Lit(int(castType.Len()))).Add(TypeCode(castType.Elem()))
+	case *types.Map:
+		return jen.Map(TypeCode(castType.Key())).Add(TypeCode(castType.Elem()))
+	case *types.Struct:
+		return jen.StructFunc(func(g *jen.Group) {
+			for i := 0; i < castType.NumFields(); i++ {
+				field := castType.Field(i)
+				var fieldCode *jen.Statement
+				if field.Embedded() {
+					fieldCode = g.Add(TypeCode(field.Type()))
+				} else {
+					fieldCode = g.Id(field.Name()).Add(TypeCode(field.Type()))
+				}
+				if tag := castType.Tag(i); tag != "" {
+					fieldCode.Op("`" + tag + "`")
+				}
+			}
+		})
+	case *types.Interface:
+		if castType.Empty() {
+			return jen.Interface()
+		}
+	}
+
+	// Anything else is only reachable through a named type
+	return jen.Id(typ.String())
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"fmt"
 	"github.com/fatih/structtag"
 	"go/types"
 	"regexp"
@@ -18,18 +19,25 @@ const (
 )
 
 type FieldInfo struct {
+	// Name is the selector path from the outermost struct, such as Embedded.Field
 	Name  string
 	Field *types.Var
 	Tag   *structtag.Tag
+	// Depth is the number of embedded structs between the field and the outermost struct
+	Depth int
+	// Pointers are the embedded pointer fields which this field is promoted through, outermost first
+	Pointers []FieldInfo
 }
 
 func (f *FieldInfo) OutputName() string {
-	if f.Tag != nil {
+	// Tags may consist solely of options, such as `bencode:",omitempty"`
+	if f.Tag != nil && f.Tag.Name != "" {
 		return f.Tag.Name
 	}
 	return strings.ToLower(splitterRegex.ReplaceAllString(f.Field.Name(), "$1 $2"))
 }
 
+// FieldSlice sorts fields into canonical order; that is, by the raw bytes of their output names
 type FieldSlice []FieldInfo
 
 func (f FieldSlice) Len() int {
@@ -37,13 +45,81 @@ func (f FieldSlice) Len() int {
 }
 
 func (f FieldSlice) Less(i, j int) bool {
-	return f[i].Name < f[j].Name
+	return f[i].OutputName() < f[j].OutputName()
 }
 
 func (f FieldSlice) Swap(i, j int) {
 	f[i], f[j] = f[j], f[i]
 }
 
+// Options are the generator-wide defaults, which fields may override with tag options
+type Options struct {
+	// NilMode is the default handling of nil pointers; one of omit, empty or error
+	NilMode string
+	// Marshalers enables encoding types which implement encoding.BinaryMarshaler or TextMarshaler as strings
+	Marshalers bool
+}
+
 type typeContext struct {
-	NeedsSort bool
+	// Tag of the field being encoded, whose options also apply to its elements
+	Tag *structtag.Tag
+	// Field being encoded, for positioning errors
+	Field *types.Var
+	// Path to the value being encoded, such as Torrent.Info, for use in errors
+	Path string
+	// Set when the enclosing field, list or map skips nil values itself
+	skipNil bool
+	// Reasons that a decoder can't be generated for this type, if any
+	NoDecode []string
+	// Number of times each variable name has been allocated
+	names map[string]int
+	// The type whose methods are being generated, if any
+	Self *types.Named
+	// Named types being expanded, outermost first, so that recursive types can be detected
+	expanding []*types.Named
+	// Types being generated in this run whose methods are called, as they may not get a ReadFrom
+	uses []*types.TypeName
+}
+
+// isExpanding reports whether a named type is already being expanded, which means that it contains itself
+func (ctx *typeContext) isExpanding(named *types.Named) bool {
+	for _, outer := range ctx.expanding {
+		if sameNamed(outer, named) {
+			return true
+		}
+	}
+	return false
+}
+
+// ident allocates a variable name which is unique within the generated function
+func (ctx *typeContext) ident(base string) string {
+	if ctx.names == nil {
+		ctx.names = make(map[string]int)
+	}
+	count := ctx.names[base]
+	ctx.names[base]++
+	if count == 0 {
+		return base
+	}
+	return fmt.Sprintf("%v%d", base, count)
+}
+
+// option returns the value of a field's tag option, which may be a plain flag or name=value
+func (ctx *typeContext) option(name string) (value string, found bool) {
+	if ctx.Tag == nil {
+		return
+	}
+	for _, opt := range ctx.Tag.Options {
+		if opt == name {
+			return "", true
+		}
+		if strings.HasPrefix(opt, name+"=") {
+			return opt[len(name)+1:], true
+		}
+	}
+	return
+}
+
+func (ctx *typeContext) noDecode(reason string) {
+	ctx.NoDecode = append(ctx.NoDecode, reason)
 }
\ No newline at end of file
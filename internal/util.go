@@ -1,12 +1,15 @@
 package internal
 
 import (
+	"fmt"
 	"github.com/fatih/structtag"
 	log "github.com/sirupsen/logrus"
 	"go/ast"
+	"go/token"
 	"go/types"
 	"os"
 	"sort"
+	"strings"
 )
 
 func must(f func() error) {
@@ -28,8 +31,21 @@ func fileExists(path string) bool {
 	return !res.IsDir()
 }
 
-func interestingDef(id *ast.Ident, obj types.Object, typeNames []string) bool {
+// typeDef returns the type declared by an identifier, if it declares one
+// Embedded fields also resolve to their type's declaration, but define a field rather than a type
+func typeDef(id *ast.Ident, obj types.Object) (*types.TypeName, bool) {
 	if id.Obj == nil || id.Obj.Kind != ast.Typ {
+		return nil, false
+	}
+	typeName, ok := obj.(*types.TypeName)
+	if !ok || typeName.IsAlias() {
+		return nil, false
+	}
+	return typeName, true
+}
+
+func interestingDef(id *ast.Ident, obj types.Object, typeNames []string) bool {
+	if _, ok := typeDef(id, obj); !ok {
 		return false
 	}
 
@@ -38,7 +54,7 @@ func interestingDef(id *ast.Ident, obj types.Object, typeNames []string) bool {
 	}
 
 	if struc, ok := obj.Type().Underlying().(*types.Struct); ok {
-		return structHasTag(struc, id.Name)
+		return structHasTag(struc, obj.Pkg(), id.Name)
 	}
 
 	return false
@@ -49,7 +65,45 @@ func isString(typ types.Type) bool {
 	return ok && (strTyp.Info()&types.IsString != 0)
 }
 
-func walkStruct(structName string, x *types.Struct, fn func(FieldInfo) bool) {
+func isInteger(typ types.Type) bool {
+	intTyp, ok := typ.Underlying().(*types.Basic)
+	return ok && (intTyp.Info()&types.IsInteger != 0)
+}
+
+func isUnsigned(typ types.Type) bool {
+	intTyp, ok := typ.Underlying().(*types.Basic)
+	return ok && (intTyp.Info()&types.IsUnsigned != 0)
+}
+
+// isByte is only true for byte itself, as slices of named byte types can't be passed to Write
+func isByte(typ types.Type) bool {
+	return types.Identical(typ, types.Typ[types.Byte])
+}
+
+func isByteArray(typ types.Type) bool {
+	arrTyp, ok := typ.Underlying().(*types.Array)
+	return ok && isByte(arrTyp.Elem())
+}
+
+func isSliceOf(typ types.Type, elem types.Type) bool {
+	sliceTyp, ok := typ.Underlying().(*types.Slice)
+	return ok && types.Identical(sliceTyp.Elem(), elem)
+}
+
+// walkStruct visits the fields of x which can be encoded by code generated in pkg
+func walkStruct(pkg *types.Package, structName string, x *types.Struct, fn func(FieldInfo) bool) {
+	walkEmbedded(pkg, structName, FieldInfo{}, x, map[*types.Struct]bool{x: true}, fn)
+}
+
+// walkEmbedded visits each field of x, descending into embedded structs
+// parent describes the path to x: its Name is the selector prefix, and its Depth the level of embedding
+// seen holds the structs being walked, so that embedding cycles are only followed once
+func walkEmbedded(pkg *types.Package, structName string, parent FieldInfo, x *types.Struct, seen map[*types.Struct]bool, fn func(FieldInfo) bool) bool {
+	prefix := ""
+	if parent.Name != "" {
+		prefix = parent.Name + "."
+	}
+
 	for i := 0; i < x.NumFields(); i++ {
 		field := x.Field(i)
 		fieldName := field.Name()
@@ -60,26 +114,163 @@ func walkStruct(structName string, x *types.Struct, fn func(FieldInfo) bool) {
 			fieldTag, _ = tags.Get("bencode")
 		}
 
-		if field.Embedded() {
-			if embedded, ok := field.Type().Underlying().(*types.Struct); ok {
-				if fieldTag != nil {
-					log.Warnf("struct tags on embedded fields are ignored (%v in %v)", fieldName, structName)
+		if skipField(field, fieldTag) {
+			continue
+		}
+		// Unexported fields can't be referred to from other packages, even if they're tagged
+		if !field.Exported() && field.Pkg() != pkg {
+			// Untagged fields would be skipped anyway, but tags and promoted fields were asked for
+			if embedded, _ := embeddedStruct(field); fieldTag != nil || embedded != nil {
+				log.Warnf("Skipping unexported field %v of %v, as it belongs to package %v",
+					prefix+fieldName, structName, field.Pkg().Path())
+			}
+			continue
+		}
+		info := FieldInfo{Name: prefix + fieldName, Field: field, Tag: fieldTag, Depth: parent.Depth, Pointers: parent.Pointers}
+
+		// Like encoding/json, embedded structs are flattened unless they're given a name
+		embedded, isPointer := embeddedStruct(field)
+		if embedded == nil || (fieldTag != nil && fieldTag.Name != "") {
+			if field.Embedded() && !field.Exported() && fieldTag == nil {
+				continue
+			}
+			if !fn(info) {
+				return false
+			}
+			continue
+		}
+
+		if fieldTag != nil {
+			log.Warnf("tags without a name are ignored on embedded structs (%v in %v)", fieldName, structName)
+		}
+		if seen[embedded] {
+			continue
+		}
+		info.Depth++
+		if isPointer {
+			// Copied, as siblings share the parent's slice
+			info.Pointers = append(append([]FieldInfo(nil), info.Pointers...), info)
+		}
+		seen[embedded] = true
+		ok := walkEmbedded(pkg, fieldName, info, embedded, seen, fn)
+		delete(seen, embedded)
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// embeddedStruct returns the struct which an embedded field promotes fields from, if any
+func embeddedStruct(field *types.Var) (embedded *types.Struct, isPointer bool) {
+	if !field.Embedded() {
+		return nil, false
+	}
+	typ := field.Type()
+	if ptr, ok := typ.Underlying().(*types.Pointer); ok {
+		typ, isPointer = ptr.Elem(), true
+	}
+	embedded, _ = typ.Underlying().(*types.Struct)
+	return embedded, isPointer
+}
+
+// dominantFields resolves fields which share an output name, following Go's rules for embedded fields
+// The shallowest field wins, and explicitly named fields beat derived names; anything else is ambiguous
+func dominantFields(fset *token.FileSet, structName string, fields FieldSlice) (toRet FieldSlice) {
+	byName := make(map[string][]FieldInfo)
+	var names []string
+	for _, f := range fields {
+		name := f.OutputName()
+		if _, ok := byName[name]; !ok {
+			names = append(names, name)
+		}
+		byName[name] = append(byName[name], f)
+	}
+
+	for _, name := range names {
+		candidates := byName[name]
+		if len(candidates) == 1 {
+			toRet = append(toRet, candidates[0])
+			continue
+		}
+
+		// Only the shallowest fields are in contention
+		minDepth := candidates[0].Depth
+		for _, f := range candidates {
+			if f.Depth < minDepth {
+				minDepth = f.Depth
+			}
+		}
+		var shallowest, named []FieldInfo
+		for _, f := range candidates {
+			if f.Depth == minDepth {
+				shallowest = append(shallowest, f)
+				if f.Tag != nil && f.Tag.Name != "" {
+					named = append(named, f)
 				}
-				walkStruct(fieldName, embedded, fn)
-			} else {
-				log.Warnf("Unsupported embedding in %v: %v", structName, fieldName)
 			}
-		} else {
-			if !fn(FieldInfo{fieldName, field, fieldTag}) {
-				return
+		}
+
+		switch {
+		case len(shallowest) == 1:
+			toRet = append(toRet, shallowest[0])
+		case len(named) > 1 || minDepth == 0:
+			// Fields declared side-by-side, or explicitly given the same name, are a genuine mistake
+			panic(fmt.Errorf("%v: dict key %q of %v.%v is also used by %v (%v)",
+				fset.Position(shallowest[1].Field.Pos()), name, structName, shallowest[1].Name,
+				shallowest[0].Name, fset.Position(shallowest[0].Field.Pos())))
+		case len(named) == 1:
+			toRet = append(toRet, named[0])
+		default:
+			var ambiguous []string
+			for _, f := range shallowest {
+				ambiguous = append(ambiguous, f.Name)
 			}
+			log.Warnf("Dropping ambiguous dict key %q of %v (from %v)", name, structName, strings.Join(ambiguous, ", "))
 		}
 	}
+
+	return
+}
+
+// skipField reports whether a field is excluded from encoding, like encoding/json does
+// `bencode:"-"` excludes a field, while `bencode:"-,"` names it "-"
+// Unexported fields are internal state, such as caches and mutexes, unless they're explicitly tagged
+func skipField(field *types.Var, tag *structtag.Tag) bool {
+	if field.Name() == "_" {
+		return true
+	}
+	if tag != nil {
+		return tag.Name == "-" && len(tag.Options) == 0
+	}
+	return !field.Exported() && !field.Embedded()
 }
 
-func structHasTag(x types.Type, structName string) (found bool) {
+// isTuple reports whether a struct is marked for encoding as a list, by a field such as
+// _ struct{} `bencode:",tuple"`
+func isTuple(x *types.Struct) bool {
+	for i := 0; i < x.NumFields(); i++ {
+		if x.Field(i).Name() != "_" {
+			continue
+		}
+		tags, err := structtag.Parse(x.Tag(i))
+		if err != nil {
+			continue
+		}
+		if tag, err := tags.Get("bencode"); err == nil && tag.HasOption("tuple") {
+			return true
+		}
+	}
+	return false
+}
+
+func structHasTag(x types.Type, pkg *types.Package, structName string) (found bool) {
 	if struc, ok := x.Underlying().(*types.Struct); ok {
-		walkStruct(structName, struc, func(f FieldInfo) bool {
+		if isTuple(struc) {
+			return true
+		}
+		walkStruct(pkg, structName, struc, func(f FieldInfo) bool {
 			if f.Tag != nil {
 				found = true
 				return false
@@ -92,7 +283,12 @@ func structHasTag(x types.Type, structName string) (found bool) {
 }
 
 func emptyMethod(typ types.Type) string {
-	switch elemType := typ.(type) {
+	// Types which know their own zero value, such as time.Time, take priority
+	if hasIsZero(typ) {
+		return "IsZero"
+	}
+
+	switch elemType := typ.Underlying().(type) {
 	case *types.Array, *types.Map, *types.Slice:
 		return "len"
 	case *types.Interface, *types.Pointer:
@@ -108,4 +304,51 @@ func emptyMethod(typ types.Type) string {
 		}
 	}
 	return ""
-}
\ No newline at end of file
+}
+
+func hasIsZero(typ types.Type) bool {
+	// Calling through a nil pointer or interface would panic, so those are checked against nil instead
+	switch typ.Underlying().(type) {
+	case *types.Pointer, *types.Interface:
+		return false
+	}
+
+	obj, _, _ := types.LookupFieldOrMethod(typ, true, nil, "IsZero")
+	method, ok := obj.(*types.Func)
+	if !ok {
+		return false
+	}
+	sig := method.Type().(*types.Signature)
+	if sig.Params().Len() != 0 || sig.Results().Len() != 1 {
+		return false
+	}
+	return types.Identical(sig.Results().At(0).Type(), types.Typ[types.Bool])
+}
+
+// sameNamed reports whether two named types are the same, treating a generic type as instantiated with its own
+// type parameters, as it is when it refers to itself
+func sameNamed(x *types.Named, y *types.Named) bool {
+	if x.Origin() != y.Origin() {
+		return false
+	}
+	xArgs, yArgs := typeArgs(x), typeArgs(y)
+	for i := range xArgs {
+		if !types.Identical(xArgs[i], yArgs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func typeArgs(named *types.Named) (args []types.Type) {
+	if named.TypeArgs().Len() == 0 {
+		for i := 0; i < named.TypeParams().Len(); i++ {
+			args = append(args, named.TypeParams().At(i))
+		}
+		return
+	}
+	for i := 0; i < named.TypeArgs().Len(); i++ {
+		args = append(args, named.TypeArgs().At(i))
+	}
+	return
+}
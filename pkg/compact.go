@@ -0,0 +1,105 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// Compact address families, as used by BEP 23 peers and BEP 5 nodes
+// CompactAny picks the smallest form for each address, and is treated as CompactIPv4 for lists
+const (
+	CompactAny  = 0
+	CompactIPv4 = 4
+	CompactIPv6 = 6
+)
+
+// AppendCompact appends the compact form of addr: its 4 or 16 byte address, followed by its port in network order
+func AppendCompact(dst []byte, addr netip.AddrPort, family int) ([]byte, error) {
+	ip := addr.Addr()
+	switch {
+	case !ip.IsValid():
+		return dst, fmt.Errorf("bencode: invalid address %v", addr)
+	case family == CompactIPv6:
+		b := ip.As16()
+		dst = append(dst, b[:]...)
+	case ip.Unmap().Is4():
+		b := ip.Unmap().As4()
+		dst = append(dst, b[:]...)
+	case family == CompactIPv4:
+		return dst, fmt.Errorf("bencode: %v is not an IPv4 address", ip)
+	default:
+		b := ip.As16()
+		dst = append(dst, b[:]...)
+	}
+	return append(dst, byte(addr.Port()>>8), byte(addr.Port())), nil
+}
+
+// WriteCompactAddr writes addr as a compact string of 6 or 18 bytes
+func WriteCompactAddr(w Writer, addr netip.AddrPort, family int) error {
+	buf, err := AppendCompact(make([]byte, 0, 18), addr, family)
+	if err != nil {
+		return err
+	}
+	return writeBytes(w, buf)
+}
+
+// WriteCompactAddrs writes addrs as a single string of concatenated compact addresses
+func WriteCompactAddrs(w Writer, addrs []netip.AddrPort, family int) error {
+	if family == CompactAny {
+		family = CompactIPv4
+	}
+	buf := make([]byte, 0, len(addrs)*compactSize(family))
+	for _, addr := range addrs {
+		var err error
+		if buf, err = AppendCompact(buf, addr, family); err != nil {
+			return err
+		}
+	}
+	return writeBytes(w, buf)
+}
+
+// ReadCompactAddr reads a compact address, which may be either size unless family is given
+func ReadCompactAddr(r Reader, family int) (netip.AddrPort, error) {
+	buf, err := ReadBytes(r)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if (family == CompactAny && len(buf) != 6 && len(buf) != 18) || (family != CompactAny && len(buf) != compactSize(family)) {
+		return netip.AddrPort{}, syntaxError(r, "invalid compact address length %d", len(buf))
+	}
+	return parseCompact(buf), nil
+}
+
+// ReadCompactAddrs reads a string of concatenated compact addresses
+func ReadCompactAddrs(r Reader, family int) ([]netip.AddrPort, error) {
+	if family == CompactAny {
+		family = CompactIPv4
+	}
+	buf, err := ReadBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	size := compactSize(family)
+	if len(buf)%size != 0 {
+		return nil, syntaxError(r, "compact address list length %d is not a multiple of %d", len(buf), size)
+	}
+	addrs := make([]netip.AddrPort, 0, len(buf)/size)
+	for i := 0; i < len(buf); i += size {
+		addrs = append(addrs, parseCompact(buf[i:i+size]))
+	}
+	return addrs, nil
+}
+
+func compactSize(family int) int {
+	if family == CompactIPv6 {
+		return 18
+	}
+	return 6
+}
+
+// parseCompact decodes a compact address, whose length must already have been checked
+func parseCompact(buf []byte) netip.AddrPort {
+	ip, _ := netip.AddrFromSlice(buf[:len(buf)-2])
+	return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(buf[len(buf)-2:]))
+}
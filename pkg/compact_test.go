@@ -0,0 +1,155 @@
+package pkg
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	// 1.2.3.4:5
+	compact4 = "\x01\x02\x03\x04\x00\x05"
+	// [::1]:6881
+	compact6 = "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1"
+	// [::ffff:1.2.3.4]:5
+	compactMapped = "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x01\x02\x03\x04\x00\x05"
+)
+
+func TestAppendCompact(t *testing.T) {
+	tests := []struct {
+		addr   netip.AddrPort
+		family int
+		want   string
+		err    bool
+	}{
+		{netip.MustParseAddrPort("1.2.3.4:5"), CompactAny, compact4, false},
+		{netip.MustParseAddrPort("1.2.3.4:5"), CompactIPv4, compact4, false},
+		{netip.MustParseAddrPort("1.2.3.4:5"), CompactIPv6, compactMapped, false},
+		{netip.MustParseAddrPort("[::ffff:1.2.3.4]:5"), CompactAny, compact4, false},
+		{netip.MustParseAddrPort("[::ffff:1.2.3.4]:5"), CompactIPv4, compact4, false},
+		{netip.MustParseAddrPort("[::ffff:1.2.3.4]:5"), CompactIPv6, compactMapped, false},
+		{netip.MustParseAddrPort("[::1]:6881"), CompactAny, compact6, false},
+		{netip.MustParseAddrPort("[::1]:6881"), CompactIPv6, compact6, false},
+		{netip.MustParseAddrPort("[::1]:6881"), CompactIPv4, "", true},
+		{netip.AddrPort{}, CompactAny, "", true},
+	}
+
+	for _, test := range tests {
+		// Appended to existing contents, which must be kept
+		got, err := AppendCompact([]byte("x"), test.addr, test.family)
+		if test.err != (err != nil) {
+			t.Errorf("AppendCompact(%v, %v) returned error %v", test.addr, test.family, err)
+			continue
+		}
+		if !test.err && string(got) != "x"+test.want {
+			t.Errorf("AppendCompact(%v, %v) = %q, expected %q", test.addr, test.family, got[1:], test.want)
+		}
+	}
+}
+
+func TestWriteCompactAddrs(t *testing.T) {
+	tests := []struct {
+		addrs  []netip.AddrPort
+		family int
+		want   string
+		err    bool
+	}{
+		{nil, CompactAny, "0:", false},
+		{[]netip.AddrPort{netip.MustParseAddrPort("1.2.3.4:5"), netip.MustParseAddrPort("1.2.3.4:5")}, CompactAny,
+			"12:" + compact4 + compact4, false},
+		// Lists are IPv4 unless asked otherwise, so that their entries are all the same size
+		{[]netip.AddrPort{netip.MustParseAddrPort("[::1]:6881")}, CompactAny, "", true},
+		{[]netip.AddrPort{netip.MustParseAddrPort("1.2.3.4:5"), netip.MustParseAddrPort("[::1]:6881")}, CompactIPv6,
+			"36:" + compactMapped + compact6, false},
+	}
+
+	for _, test := range tests {
+		var out strings.Builder
+		err := WriteCompactAddrs(&out, test.addrs, test.family)
+		if test.err != (err != nil) {
+			t.Errorf("WriteCompactAddrs(%v, %v) returned error %v", test.addrs, test.family, err)
+			continue
+		}
+		if !test.err && out.String() != test.want {
+			t.Errorf("WriteCompactAddrs(%v, %v) = %q, expected %q", test.addrs, test.family, out.String(), test.want)
+		}
+	}
+}
+
+func TestReadCompactAddr(t *testing.T) {
+	tests := []struct {
+		input  string
+		family int
+		want   netip.AddrPort
+		// Expected error message, if any
+		errMsg string
+	}{
+		{"6:" + compact4, CompactAny, netip.MustParseAddrPort("1.2.3.4:5"), ""},
+		{"6:" + compact4, CompactIPv4, netip.MustParseAddrPort("1.2.3.4:5"), ""},
+		{"18:" + compact6, CompactAny, netip.MustParseAddrPort("[::1]:6881"), ""},
+		{"18:" + compact6, CompactIPv6, netip.MustParseAddrPort("[::1]:6881"), ""},
+		// Mapped addresses are kept as they were sent
+		{"18:" + compactMapped, CompactIPv6, netip.MustParseAddrPort("[::ffff:1.2.3.4]:5"), ""},
+		{"6:" + compact4, CompactIPv6, netip.AddrPort{}, "invalid compact address length 6"},
+		{"18:" + compact6, CompactIPv4, netip.AddrPort{}, "invalid compact address length 18"},
+		{"5:\x01\x02\x03\x04\x00", CompactAny, netip.AddrPort{}, "invalid compact address length 5"},
+		{"0:", CompactAny, netip.AddrPort{}, "invalid compact address length 0"},
+		{"i1e", CompactAny, netip.AddrPort{}, "unexpected 'i'"},
+	}
+
+	for _, test := range tests {
+		got, err := ReadCompactAddr(NewDecoder(strings.NewReader(test.input)), test.family)
+		if test.errMsg != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+				t.Errorf("ReadCompactAddr(%q, %v) returned error %v, expected one containing %q",
+					test.input, test.family, err, test.errMsg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ReadCompactAddr(%q, %v) returned error %v", test.input, test.family, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ReadCompactAddr(%q, %v) = %v, expected %v", test.input, test.family, got, test.want)
+		}
+	}
+}
+
+func TestReadCompactAddrs(t *testing.T) {
+	tests := []struct {
+		input  string
+		family int
+		want   []netip.AddrPort
+		// Expected error message, if any
+		errMsg string
+	}{
+		{"0:", CompactAny, []netip.AddrPort{}, ""},
+		{"12:" + compact4 + compact4, CompactAny,
+			[]netip.AddrPort{netip.MustParseAddrPort("1.2.3.4:5"), netip.MustParseAddrPort("1.2.3.4:5")}, ""},
+		{"36:" + compact6 + compactMapped, CompactIPv6,
+			[]netip.AddrPort{netip.MustParseAddrPort("[::1]:6881"), netip.MustParseAddrPort("[::ffff:1.2.3.4]:5")}, ""},
+		{"7:" + compact4 + "\x00", CompactIPv4, nil, "length 7 is not a multiple of 6"},
+		{"12:" + compact4 + compact4, CompactIPv6, nil, "length 12 is not a multiple of 18"},
+		{"i1e", CompactAny, nil, "unexpected 'i'"},
+	}
+
+	for _, test := range tests {
+		got, err := ReadCompactAddrs(NewDecoder(strings.NewReader(test.input)), test.family)
+		if test.errMsg != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+				t.Errorf("ReadCompactAddrs(%q, %v) returned error %v, expected one containing %q",
+					test.input, test.family, err, test.errMsg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ReadCompactAddrs(%q, %v) returned error %v", test.input, test.family, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ReadCompactAddrs(%q, %v) = %v, expected %v", test.input, test.family, got, test.want)
+		}
+	}
+}
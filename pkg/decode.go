@@ -0,0 +1,533 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"reflect"
+	"strconv"
+)
+
+const maxPrealloc = 64 * 1024
+
+var ErrArrayLength = errors.New("bencode: too many elements for array")
+
+// Expect consumes the next byte from r, failing if it isn't c
+func Expect(r Reader, c byte) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return noEOF(r, err)
+	}
+	if b != c {
+		return syntaxError(r, "expected %q, found %q", c, b)
+	}
+	return nil
+}
+
+// More reports whether the current list or dict has any items left
+// The terminating 'e' is left unread, so that the caller can Expect it
+func More(r Reader) (bool, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return false, noEOF(r, err)
+	}
+	if err = r.UnreadByte(); err != nil {
+		return false, err
+	}
+	return b != 'e', nil
+}
+
+// ReadInt reads an integer which must fit into bitSize bits, as per strconv.ParseInt
+func ReadInt(r Reader, bitSize int) (int64, error) {
+	if err := Expect(r, 'i'); err != nil {
+		return 0, err
+	}
+	digits, err := readDigits(r, 'e', true)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(digits, 10, bitSize)
+	if err != nil {
+		return 0, syntaxError(r, "integer %v out of range", digits)
+	}
+	return n, nil
+}
+
+// ReadUint reads a non-negative integer which must fit into bitSize bits, as per strconv.ParseUint
+func ReadUint(r Reader, bitSize int) (uint64, error) {
+	if err := Expect(r, 'i'); err != nil {
+		return 0, err
+	}
+	digits, err := readDigits(r, 'e', true)
+	if err != nil {
+		return 0, err
+	}
+	if digits[0] == '-' {
+		return 0, syntaxError(r, "negative integer %v for unsigned value", digits)
+	}
+	n, err := strconv.ParseUint(digits, 10, bitSize)
+	if err != nil {
+		return 0, syntaxError(r, "integer %v out of range", digits)
+	}
+	return n, nil
+}
+
+// ReadBigInt reads an integer of any size into dst
+func ReadBigInt(r Reader, dst *big.Int) error {
+	if err := Expect(r, 'i'); err != nil {
+		return err
+	}
+	digits, err := readDigits(r, 'e', true)
+	if err != nil {
+		return err
+	}
+	if _, ok := dst.SetString(digits, 10); !ok {
+		return syntaxError(r, "invalid integer %v", digits)
+	}
+	return nil
+}
+
+// ReadFloat reads a decimal string holding a float of bitSize bits, as per strconv.ParseFloat
+func ReadFloat(r Reader, bitSize int) (float64, error) {
+	str, err := ReadString(r)
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(str, bitSize)
+	if err != nil {
+		return 0, syntaxError(r, "invalid float %q", str)
+	}
+	return f, nil
+}
+
+// ReadIntKey reads a dict key holding a decimal integer, as written for integer-keyed maps
+func ReadIntKey(r Reader, bitSize int) (int64, error) {
+	key, err := ReadString(r)
+	if err != nil {
+		return 0, err
+	}
+	if !canonicalInt(key, true) {
+		return 0, syntaxError(r, "invalid integer key %q", key)
+	}
+	n, err := strconv.ParseInt(key, 10, bitSize)
+	if err != nil {
+		return 0, syntaxError(r, "integer key %v out of range", key)
+	}
+	return n, nil
+}
+
+// ReadUintKey reads a dict key holding a non-negative decimal integer
+func ReadUintKey(r Reader, bitSize int) (uint64, error) {
+	key, err := ReadString(r)
+	if err != nil {
+		return 0, err
+	}
+	if !canonicalInt(key, false) {
+		return 0, syntaxError(r, "invalid unsigned integer key %q", key)
+	}
+	n, err := strconv.ParseUint(key, 10, bitSize)
+	if err != nil {
+		return 0, syntaxError(r, "integer key %v out of range", key)
+	}
+	return n, nil
+}
+
+func ReadString(r Reader) (string, error) {
+	buf, err := ReadBytes(r)
+	return string(buf), err
+}
+
+func ReadBytes(r Reader) ([]byte, error) {
+	digits, err := readDigits(r, ':', false)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil {
+		return nil, syntaxError(r, "string length %v out of range", digits)
+	}
+	// Don't trust the length prefix with a large up-front allocation
+	buf := bytes.NewBuffer(make([]byte, 0, minInt(n, maxPrealloc)))
+	if _, err = io.CopyN(buf, r, int64(n)); err != nil {
+		return nil, noEOF(r, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadFixedBytes reads a string which must be exactly len(dst) bytes long into dst
+func ReadFixedBytes(r Reader, dst []byte) error {
+	digits, err := readDigits(r, ':', false)
+	if err != nil {
+		return err
+	}
+	if digits != strconv.Itoa(len(dst)) {
+		return syntaxError(r, "expected a %d byte string, found %v bytes", len(dst), digits)
+	}
+	if _, err = io.ReadFull(r, dst); err != nil {
+		return noEOF(r, err)
+	}
+	return nil
+}
+
+// ReadValue reads a value of any type into its dynamic form, for decoding interface{} fields
+// Integers are returned as int64, strings as string, and containers as []interface{} or map[string]interface{}
+func ReadValue(r Reader) (interface{}, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, noEOF(r, err)
+	}
+	if err = r.UnreadByte(); err != nil {
+		return nil, err
+	}
+
+	switch b {
+	case 'i':
+		n, err := ReadInt(r, 64)
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
+	case 'l':
+		list := []interface{}{}
+		err = readContainer(r, 'l', func() error {
+			elem, err := ReadValue(r)
+			list = append(list, elem)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return list, nil
+	case 'd':
+		dict := map[string]interface{}{}
+		err = readContainer(r, 'd', func() error {
+			key, err := ReadString(r)
+			if err != nil {
+				return err
+			}
+			dict[key], err = ReadValue(r)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return dict, nil
+	default:
+		str, err := ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		return str, nil
+	}
+}
+
+// ReadInto reads a value into dst, a pointer whose type is only known at runtime, such as a type parameter field
+func ReadInto(r Reader, dst interface{}) (err error) {
+	if v := reflect.ValueOf(dst); v.Kind() != reflect.Ptr || v.IsNil() {
+		return &UnsupportedTypeError{dst}
+	}
+	switch dst := dst.(type) {
+	case Unmarshaler:
+		return dst.ReadFrom(r)
+	case *string:
+		*dst, err = ReadString(r)
+	case *[]byte:
+		*dst, err = ReadBytes(r)
+	case *int:
+		var n int64
+		n, err = ReadInt(r, strconv.IntSize)
+		*dst = int(n)
+	case *int8:
+		var n int64
+		n, err = ReadInt(r, 8)
+		*dst = int8(n)
+	case *int16:
+		var n int64
+		n, err = ReadInt(r, 16)
+		*dst = int16(n)
+	case *int32:
+		var n int64
+		n, err = ReadInt(r, 32)
+		*dst = int32(n)
+	case *int64:
+		*dst, err = ReadInt(r, 64)
+	case *uint:
+		var n uint64
+		n, err = ReadUint(r, strconv.IntSize)
+		*dst = uint(n)
+	case *uint8:
+		var n uint64
+		n, err = ReadUint(r, 8)
+		*dst = uint8(n)
+	case *uint16:
+		var n uint64
+		n, err = ReadUint(r, 16)
+		*dst = uint16(n)
+	case *uint32:
+		var n uint64
+		n, err = ReadUint(r, 32)
+		*dst = uint32(n)
+	case *uint64:
+		*dst, err = ReadUint(r, 64)
+	case *bool:
+		var n int64
+		n, err = ReadInt(r, 64)
+		*dst = n != 0
+	case *interface{}:
+		*dst, err = ReadValue(r)
+	case *[]interface{}:
+		var v interface{}
+		if v, err = ReadValue(r); err != nil {
+			return
+		}
+		var ok bool
+		if *dst, ok = v.([]interface{}); !ok {
+			return syntaxError(r, "expected a list, found %T", v)
+		}
+	case *map[string]interface{}:
+		var v interface{}
+		if v, err = ReadValue(r); err != nil {
+			return
+		}
+		var ok bool
+		if *dst, ok = v.(map[string]interface{}); !ok {
+			return syntaxError(r, "expected a dict, found %T", v)
+		}
+	default:
+		return readReflect(r, reflect.ValueOf(dst).Elem())
+	}
+	return
+}
+
+// readReflect reads into v by its kind, for types which ReadInto doesn't know by name, such as named integers
+func readReflect(r Reader, v reflect.Value) (err error) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		// Pointer type arguments, such as *Info, are allocated and then read through
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return ReadInto(r, v.Interface())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		if n, err = ReadInt(r, v.Type().Bits()); err == nil {
+			v.SetInt(n)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var n uint64
+		if n, err = ReadUint(r, v.Type().Bits()); err == nil {
+			v.SetUint(n)
+		}
+	case reflect.Bool:
+		var n int64
+		if n, err = ReadInt(r, 64); err == nil {
+			v.SetBool(n != 0)
+		}
+	case reflect.String:
+		var s string
+		if s, err = ReadString(r); err == nil {
+			v.SetString(s)
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			var b []byte
+			if b, err = ReadBytes(r); err == nil {
+				v.Set(reflect.ValueOf(b).Convert(v.Type()))
+			}
+			return
+		}
+		v.Set(v.Slice(0, 0))
+		return readContainer(r, 'l', func() error {
+			elem := reflect.New(v.Type().Elem())
+			if err := ReadInto(r, elem.Interface()); err != nil {
+				return err
+			}
+			v.Set(reflect.Append(v, elem.Elem()))
+			return nil
+		})
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			if err = ReadFixedBytes(r, b); err == nil {
+				reflect.Copy(v, reflect.ValueOf(b))
+			}
+			return
+		}
+		n := 0
+		return readContainer(r, 'l', func() error {
+			if n >= v.Len() {
+				return ErrArrayLength
+			}
+			n++
+			return ReadInto(r, v.Index(n-1).Addr().Interface())
+		})
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return &UnsupportedTypeError{v.Addr().Interface()}
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		return readContainer(r, 'd', func() error {
+			key, err := ReadString(r)
+			if err != nil {
+				return err
+			}
+			elem := reflect.New(v.Type().Elem())
+			if err = ReadInto(r, elem.Interface()); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem.Elem())
+			return nil
+		})
+	default:
+		return &UnsupportedTypeError{v.Addr().Interface()}
+	}
+	return
+}
+
+// readContainer calls fn for each item of a list or dict, until its terminating 'e'
+func readContainer(r Reader, c byte, fn func() error) error {
+	if err := Expect(r, c); err != nil {
+		return err
+	}
+	for {
+		more, err := More(r)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return Expect(r, 'e')
+		}
+		if err = fn(); err != nil {
+			return err
+		}
+	}
+}
+
+// Skip consumes a single value of any type, such as the value of an unknown dict key
+func Skip(r Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return noEOF(r, err)
+	}
+
+	switch b {
+	case 'i':
+		_, err = readDigits(r, 'e', true)
+		return err
+	case 'l', 'd':
+		for {
+			more, err := More(r)
+			if err != nil {
+				return err
+			}
+			if !more {
+				return Expect(r, 'e')
+			}
+			if b == 'd' {
+				if err = skipString(r); err != nil {
+					return err
+				}
+			}
+			if err = Skip(r); err != nil {
+				return err
+			}
+		}
+	default:
+		if err = r.UnreadByte(); err != nil {
+			return err
+		}
+		return skipString(r)
+	}
+}
+
+func skipString(r Reader) error {
+	digits, err := readDigits(r, ':', false)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return syntaxError(r, "string length %v out of range", digits)
+	}
+	if _, err = io.CopyN(ioutil.Discard, r, n); err != nil {
+		return noEOF(r, err)
+	}
+	return nil
+}
+
+// readDigits reads a canonical decimal number up to (and consuming) term
+// Leading zeroes are rejected, as is "-0"
+func readDigits(r Reader, term byte, signed bool) (string, error) {
+	var buf []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", noEOF(r, err)
+		}
+		switch {
+		case b == term:
+			digits := string(buf)
+			if digits == "" || digits == "-" {
+				return "", syntaxError(r, "missing digits before %q", term)
+			}
+			if !canonicalInt(digits, signed) {
+				return "", syntaxError(r, "non-canonical number %v", digits)
+			}
+			return digits, nil
+		case b == '-' && signed && len(buf) == 0:
+		case b >= '0' && b <= '9':
+		default:
+			return "", syntaxError(r, "unexpected %q in number", b)
+		}
+		buf = append(buf, b)
+	}
+}
+
+// canonicalInt reports whether s is a decimal integer with no sign (unless negative) or leading zeroes
+func canonicalInt(s string, signed bool) bool {
+	digits := s
+	if signed && len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+	}
+	if digits == "" || (digits[0] == '0' && len(s) > 1) {
+		return false
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// noEOF reports running out of input mid-value as io.ErrUnexpectedEOF, positioned if r is able to track it
+func noEOF(r Reader, err error) error {
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if d, ok := r.(*Decoder); ok {
+		return &SyntaxError{Offset: d.offset, Msg: "unexpected end of input", Err: io.ErrUnexpectedEOF}
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// syntaxError positions an error at the last byte read, if r is able to track it
+func syntaxError(r Reader, format string, args ...interface{}) error {
+	offset := int64(-1)
+	if d, ok := r.(*Decoder); ok {
+		offset = d.offset - 1
+	}
+	return &SyntaxError{Offset: offset, Msg: fmt.Sprintf(format, args...)}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,235 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+type TokenKind int
+
+const (
+	DictStart TokenKind = iota
+	ListStart
+	Integer
+	ByteString
+	End
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case DictStart:
+		return "dict start"
+	case ListStart:
+		return "list start"
+	case Integer:
+		return "integer"
+	case ByteString:
+		return "string"
+	case End:
+		return "end"
+	}
+	return fmt.Sprintf("TokenKind(%d)", int(k))
+}
+
+type Token struct {
+	Kind TokenKind
+	// Offset of the token's first byte in the input
+	Offset int64
+	// Value holds the decimal digits of an Integer, or the contents of a ByteString
+	Value []byte
+}
+
+type SyntaxError struct {
+	// Offset of the offending byte in the input, or -1 if the reader doesn't track it
+	Offset int64
+	Msg    string
+	// Err is the underlying error, such as io.ErrUnexpectedEOF for truncated input
+	Err error
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Offset < 0 {
+		return "bencode: " + e.Msg
+	}
+	return fmt.Sprintf("bencode: %v (at offset %d)", e.Msg, e.Offset)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// Decoder is a pull parser which reads a stream of tokens from its input
+// It also implements Reader, so that it can be passed to generated ReadFrom methods to get positioned errors
+// Between calls to Token, whole values should be read through Decode or Skip, which keep track of the nesting;
+// reading one directly through the Reader methods leaves Token expecting it still
+type Decoder struct {
+	r      Reader
+	offset int64
+	// One entry per open container
+	stack []frame
+}
+
+type frame struct {
+	dict    bool
+	wantKey bool
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	reader, ok := r.(Reader)
+	if !ok {
+		reader = bufio.NewReader(r)
+	}
+	return &Decoder{r: reader}
+}
+
+// Offset returns the offset of the next unread byte
+func (d *Decoder) Offset() int64 {
+	return d.offset
+}
+
+// Token returns the next token in the input
+// io.EOF is only returned if the input ends between top-level values
+func (d *Decoder) Token() (tok Token, err error) {
+	tok.Offset = d.offset
+	b, err := d.ReadByte()
+	if err != nil {
+		if len(d.stack) != 0 {
+			err = noEOF(d, err)
+		}
+		return
+	}
+
+	// Dict keys must be strings
+	var top *frame
+	if len(d.stack) != 0 {
+		top = &d.stack[len(d.stack)-1]
+	}
+	expectingKey := top != nil && top.dict && top.wantKey
+	if expectingKey && b != 'e' && (b < '0' || b > '9') {
+		return tok, &SyntaxError{Offset: tok.Offset, Msg: fmt.Sprintf("dict key must be a string, found %q", b)}
+	}
+
+	switch {
+	case b == 'd':
+		tok.Kind = DictStart
+	case b == 'l':
+		tok.Kind = ListStart
+	case b == 'e':
+		if top == nil {
+			return tok, &SyntaxError{Offset: tok.Offset, Msg: "unexpected end of container"}
+		}
+		if top.dict && !expectingKey {
+			return tok, &SyntaxError{Offset: tok.Offset, Msg: "missing value for dict key"}
+		}
+		tok.Kind = End
+	case b == 'i':
+		tok.Kind = Integer
+		var digits string
+		if digits, err = readDigits(d, 'e', true); err != nil {
+			return
+		}
+		tok.Value = []byte(digits)
+	case b >= '0' && b <= '9':
+		tok.Kind = ByteString
+		if err = d.UnreadByte(); err != nil {
+			return
+		}
+		if tok.Value, err = ReadBytes(d); err != nil {
+			return
+		}
+	default:
+		return tok, &SyntaxError{Offset: tok.Offset, Msg: fmt.Sprintf("unexpected %q", b)}
+	}
+
+	// Keep track of our nesting; completed values flip their dict between key and value
+	switch tok.Kind {
+	case DictStart:
+		d.stack = append(d.stack, frame{dict: true, wantKey: true})
+		return
+	case ListStart:
+		d.stack = append(d.stack, frame{})
+		return
+	case End:
+		d.stack = d.stack[:len(d.stack)-1]
+	}
+	d.completed()
+
+	return
+}
+
+// Decode reads the next whole value into v, such as the value of a dict key returned by Token
+// Like Token, io.EOF is only returned if the input ends between top-level values
+func (d *Decoder) Decode(v Unmarshaler) error {
+	return d.value(func() error {
+		return v.ReadFrom(d)
+	})
+}
+
+// Skip discards the next whole value
+func (d *Decoder) Skip() error {
+	return d.value(func() error {
+		return Skip(d)
+	})
+}
+
+// value checks that a whole value may start here, then reads it with read and marks it as done
+func (d *Decoder) value(read func() error) error {
+	offset := d.offset
+	b, err := d.ReadByte()
+	if err != nil {
+		if len(d.stack) != 0 {
+			err = noEOF(d, err)
+		}
+		return err
+	}
+	if err = d.UnreadByte(); err != nil {
+		return err
+	}
+
+	if b == 'e' {
+		return &SyntaxError{Offset: offset, Msg: "expected a value, found end of container"}
+	}
+	if len(d.stack) != 0 {
+		top := d.stack[len(d.stack)-1]
+		if top.dict && top.wantKey && (b < '0' || b > '9') {
+			return &SyntaxError{Offset: offset, Msg: fmt.Sprintf("dict key must be a string, found %q", b)}
+		}
+	}
+
+	if err = read(); err != nil {
+		return err
+	}
+	d.completed()
+	return nil
+}
+
+// completed flips the innermost dict between expecting a key and a value, after either has been read
+func (d *Decoder) completed() {
+	if len(d.stack) != 0 {
+		top := &d.stack[len(d.stack)-1]
+		top.wantKey = top.dict && !top.wantKey
+	}
+}
+
+func (d *Decoder) ReadByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err == nil {
+		d.offset++
+	}
+	return b, err
+}
+
+func (d *Decoder) UnreadByte() error {
+	err := d.r.UnreadByte()
+	if err == nil {
+		d.offset--
+	}
+	return err
+}
+
+func (d *Decoder) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,542 @@
+package pkg
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checkErr fails unless err is a SyntaxError at offset whose message contains msg, or nil if msg is empty
+func checkErr(t *testing.T, err error, offset int64, msg string) {
+	t.Helper()
+	if msg == "" {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return
+	}
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("expected a SyntaxError containing %q, got %v", msg, err)
+	}
+	if syntaxErr.Offset != offset || !strings.Contains(syntaxErr.Msg, msg) {
+		t.Fatalf("expected %q at offset %d, got %q at offset %d", msg, offset, syntaxErr.Msg, syntaxErr.Offset)
+	}
+}
+
+func TestDecoderToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		tokens []Token
+		// Expected error after the tokens, if any
+		errOffset int64
+		errMsg    string
+	}{
+		{
+			name:   "integer",
+			input:  "i-42e",
+			tokens: []Token{{Integer, 0, []byte("-42")}},
+		},
+		{
+			name:   "zero",
+			input:  "i0e",
+			tokens: []Token{{Integer, 0, []byte("0")}},
+		},
+		{
+			name:   "empty string",
+			input:  "0:",
+			tokens: []Token{{ByteString, 0, []byte{}}},
+		},
+		{
+			name:  "nested",
+			input: "d3:fooli1e2:abee",
+			tokens: []Token{
+				{DictStart, 0, nil},
+				{ByteString, 1, []byte("foo")},
+				{ListStart, 6, nil},
+				{Integer, 7, []byte("1")},
+				{ByteString, 10, []byte("ab")},
+				{End, 14, nil},
+				{End, 15, nil},
+			},
+		},
+		{
+			name:   "consecutive values",
+			input:  "i1e1:a",
+			tokens: []Token{{Integer, 0, []byte("1")}, {ByteString, 3, []byte("a")}},
+		},
+		{
+			name:      "negative zero",
+			input:     "i-0e",
+			errOffset: 3,
+			errMsg:    "non-canonical number -0",
+		},
+		{
+			name:      "leading zero",
+			input:     "i01e",
+			errOffset: 3,
+			errMsg:    "non-canonical number 01",
+		},
+		{
+			name:      "leading zero length",
+			input:     "03:abc",
+			errOffset: 2,
+			errMsg:    "non-canonical number 03",
+		},
+		{
+			name:      "empty integer",
+			input:     "ie",
+			errOffset: 1,
+			errMsg:    "missing digits",
+		},
+		{
+			name:      "bad digit",
+			input:     "i1x2e",
+			errOffset: 2,
+			errMsg:    "unexpected 'x' in number",
+		},
+		{
+			name:      "integer dict key",
+			input:     "di1ei2ee",
+			tokens:    []Token{{DictStart, 0, nil}},
+			errOffset: 1,
+			errMsg:    "dict key must be a string",
+		},
+		{
+			name:      "list dict key",
+			input:     "d1:ai1eli1eee",
+			tokens:    []Token{{DictStart, 0, nil}, {ByteString, 1, []byte("a")}, {Integer, 4, []byte("1")}},
+			errOffset: 7,
+			errMsg:    "dict key must be a string",
+		},
+		{
+			name:      "missing dict value",
+			input:     "d3:fooe",
+			tokens:    []Token{{DictStart, 0, nil}, {ByteString, 1, []byte("foo")}},
+			errOffset: 6,
+			errMsg:    "missing value for dict key",
+		},
+		{
+			name:      "stray end",
+			input:     "e",
+			errOffset: 0,
+			errMsg:    "unexpected end of container",
+		},
+		{
+			name:      "stray end after value",
+			input:     "li1eee",
+			tokens:    []Token{{ListStart, 0, nil}, {Integer, 1, []byte("1")}, {End, 4, nil}},
+			errOffset: 5,
+			errMsg:    "unexpected end of container",
+		},
+		{
+			name:      "unknown byte",
+			input:     "x",
+			errOffset: 0,
+			errMsg:    "unexpected 'x'",
+		},
+		{
+			name:      "truncated list",
+			input:     "li1e",
+			tokens:    []Token{{ListStart, 0, nil}, {Integer, 1, []byte("1")}},
+			errOffset: 4,
+			errMsg:    "unexpected end of input",
+		},
+		{
+			name:      "truncated integer",
+			input:     "i12",
+			errOffset: 3,
+			errMsg:    "unexpected end of input",
+		},
+		{
+			name:      "truncated string",
+			input:     "5:abc",
+			errOffset: 5,
+			errMsg:    "unexpected end of input",
+		},
+		{
+			name:      "truncated length",
+			input:     "12",
+			errOffset: 2,
+			errMsg:    "unexpected end of input",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDecoder(strings.NewReader(test.input))
+			for _, want := range test.tokens {
+				tok, err := d.Token()
+				if err != nil {
+					t.Fatalf("unexpected error before %v token: %v", want.Kind, err)
+				}
+				if tok.Kind != want.Kind || tok.Offset != want.Offset || string(tok.Value) != string(want.Value) {
+					t.Fatalf("expected %v %q at %d, got %v %q at %d",
+						want.Kind, want.Value, want.Offset, tok.Kind, tok.Value, tok.Offset)
+				}
+			}
+
+			_, err := d.Token()
+			if test.errMsg == "" {
+				if err != io.EOF {
+					t.Fatalf("expected io.EOF after the last token, got %v", err)
+				}
+				return
+			}
+			checkErr(t, err, test.errOffset, test.errMsg)
+		})
+	}
+}
+
+// readFunc adapts a function to Unmarshaler
+type readFunc func(r Reader) error
+
+func (f readFunc) ReadFrom(r Reader) error {
+	return f(r)
+}
+
+// TestDecoderValues interleaves Token with Decode and Skip, which read whole values
+func TestDecoderValues(t *testing.T) {
+	token := func(d *Decoder) (interface{}, error) {
+		tok, err := d.Token()
+		return tok.Kind, err
+	}
+	decode := func(d *Decoder) (v interface{}, err error) {
+		err = d.Decode(readFunc(func(r Reader) (err error) {
+			v, err = ReadValue(r)
+			return
+		}))
+		return
+	}
+	skip := func(d *Decoder) (interface{}, error) {
+		return nil, d.Skip()
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		steps []func(d *Decoder) (interface{}, error)
+		want  []interface{}
+		// Expected error from the last step, if any
+		errOffset int64
+		errMsg    string
+	}{
+		{
+			name:  "decode dict value",
+			input: "d4:infod4:name1:ne1:xi1ee",
+			steps: []func(d *Decoder) (interface{}, error){token, token, decode, token, token, token},
+			want: []interface{}{DictStart, ByteString, map[string]interface{}{"name": "n"}, ByteString, Integer,
+				End},
+		},
+		{
+			name:  "skip dict value",
+			input: "d4:infod4:name1:ne1:xi1ee",
+			steps: []func(d *Decoder) (interface{}, error){token, token, skip, token, token, token},
+			want:  []interface{}{DictStart, ByteString, nil, ByteString, Integer, End},
+		},
+		{
+			name:  "decode dict key",
+			input: "d1:ai1ee",
+			steps: []func(d *Decoder) (interface{}, error){token, decode, token, token},
+			want:  []interface{}{DictStart, "a", Integer, End},
+		},
+		{
+			name:  "decode list elements",
+			input: "lli1eei2ee",
+			steps: []func(d *Decoder) (interface{}, error){token, decode, decode, token},
+			want:  []interface{}{ListStart, []interface{}{int64(1)}, int64(2), End},
+		},
+		{
+			name:  "decode top level",
+			input: "i1e1:a",
+			steps: []func(d *Decoder) (interface{}, error){decode, decode},
+			want:  []interface{}{int64(1), "a"},
+		},
+		{
+			name:      "decode non-string key",
+			input:     "di1ei2ee",
+			steps:     []func(d *Decoder) (interface{}, error){token, decode},
+			want:      []interface{}{DictStart},
+			errOffset: 1,
+			errMsg:    "dict key must be a string, found 'i'",
+		},
+		{
+			name:      "skip end",
+			input:     "le",
+			steps:     []func(d *Decoder) (interface{}, error){token, skip},
+			want:      []interface{}{ListStart},
+			errOffset: 1,
+			errMsg:    "expected a value, found end of container",
+		},
+		{
+			name:      "decode truncated",
+			input:     "d1:a",
+			steps:     []func(d *Decoder) (interface{}, error){token, token, decode},
+			want:      []interface{}{DictStart, ByteString},
+			errOffset: 4,
+			errMsg:    "unexpected end of input",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDecoder(strings.NewReader(test.input))
+			for i, step := range test.steps {
+				got, err := step(d)
+				if i == len(test.want) {
+					checkErr(t, err, test.errOffset, test.errMsg)
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error at step %d: %v", i, err)
+				}
+				if !reflect.DeepEqual(got, test.want[i]) {
+					t.Fatalf("expected %#v at step %d, got %#v", test.want[i], i, got)
+				}
+			}
+
+			// Whole values at the top level end the same way tokens do
+			if _, err := decode(d); err != io.EOF {
+				t.Fatalf("expected io.EOF after the last value, got %v", err)
+			}
+		})
+	}
+}
+
+func TestTruncatedUnwrap(t *testing.T) {
+	d := NewDecoder(strings.NewReader("l"))
+	_, err := d.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.Token(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	// Readers which don't track their offset get the bare error
+	if _, err = ReadInt(strings.NewReader("i1"), 64); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestReaders(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		read  func(r Reader) (interface{}, error)
+		want  interface{}
+		// Offset of the decoder after a successful read
+		offset    int64
+		errOffset int64
+		errMsg    string
+	}{
+		{
+			name:   "expect",
+			input:  "d",
+			read:   func(r Reader) (interface{}, error) { return nil, Expect(r, 'd') },
+			offset: 1,
+		},
+		{
+			name:      "expect mismatch",
+			input:     "l",
+			read:      func(r Reader) (interface{}, error) { return nil, Expect(r, 'd') },
+			errOffset: 0,
+			errMsg:    "expected 'd', found 'l'",
+		},
+		{
+			name:      "expect truncated",
+			input:     "",
+			read:      func(r Reader) (interface{}, error) { return nil, Expect(r, 'd') },
+			errOffset: 0,
+			errMsg:    "unexpected end of input",
+		},
+		{
+			name:   "more",
+			input:  "i1e",
+			read:   func(r Reader) (interface{}, error) { return More(r) },
+			want:   true,
+			offset: 0,
+		},
+		{
+			name:   "no more",
+			input:  "e",
+			read:   func(r Reader) (interface{}, error) { return More(r) },
+			want:   false,
+			offset: 0,
+		},
+		{
+			name:   "int",
+			input:  "i-128e",
+			read:   func(r Reader) (interface{}, error) { return ReadInt(r, 8) },
+			want:   int64(-128),
+			offset: 6,
+		},
+		{
+			name:      "int out of range",
+			input:     "i128e",
+			read:      func(r Reader) (interface{}, error) { return ReadInt(r, 8) },
+			errOffset: 4,
+			errMsg:    "integer 128 out of range",
+		},
+		{
+			name:      "int non-canonical",
+			input:     "i-0e",
+			read:      func(r Reader) (interface{}, error) { return ReadInt(r, 64) },
+			errOffset: 3,
+			errMsg:    "non-canonical number -0",
+		},
+		{
+			name:      "int not an int",
+			input:     "1:a",
+			read:      func(r Reader) (interface{}, error) { return ReadInt(r, 64) },
+			errOffset: 0,
+			errMsg:    "expected 'i', found '1'",
+		},
+		{
+			name:      "uint negative",
+			input:     "i-1e",
+			read:      func(r Reader) (interface{}, error) { return ReadUint(r, 64) },
+			errOffset: 3,
+			errMsg:    "negative integer -1",
+		},
+		{
+			name:   "bytes",
+			input:  "3:abc",
+			read:   func(r Reader) (interface{}, error) { return ReadBytes(r) },
+			want:   []byte("abc"),
+			offset: 5,
+		},
+		{
+			name:      "bytes non-canonical length",
+			input:     "03:abc",
+			read:      func(r Reader) (interface{}, error) { return ReadBytes(r) },
+			errOffset: 2,
+			errMsg:    "non-canonical number 03",
+		},
+		{
+			name:      "bytes truncated",
+			input:     "4:abc",
+			read:      func(r Reader) (interface{}, error) { return ReadBytes(r) },
+			errOffset: 5,
+			errMsg:    "unexpected end of input",
+		},
+		{
+			name:  "fixed bytes",
+			input: "2:ab",
+			read: func(r Reader) (interface{}, error) {
+				var dst [2]byte
+				err := ReadFixedBytes(r, dst[:])
+				return dst, err
+			},
+			want:   [2]byte{'a', 'b'},
+			offset: 4,
+		},
+		{
+			name:  "fixed bytes wrong length",
+			input: "3:abc",
+			read: func(r Reader) (interface{}, error) {
+				return nil, ReadFixedBytes(r, make([]byte, 2))
+			},
+			errOffset: 1,
+			errMsg:    "expected a 2 byte string, found 3 bytes",
+		},
+		{
+			name:  "fixed bytes truncated",
+			input: "2:a",
+			read: func(r Reader) (interface{}, error) {
+				return nil, ReadFixedBytes(r, make([]byte, 2))
+			},
+			errOffset: 3,
+			errMsg:    "unexpected end of input",
+		},
+		{
+			name:   "skip",
+			input:  "d1:ali1e0:d1:bi2eeeei9e",
+			read:   func(r Reader) (interface{}, error) { return nil, Skip(r) },
+			offset: 20,
+		},
+		{
+			name:      "skip non-canonical",
+			input:     "li01ee",
+			read:      func(r Reader) (interface{}, error) { return nil, Skip(r) },
+			errOffset: 4,
+			errMsg:    "non-canonical number 01",
+		},
+		{
+			name:      "skip truncated",
+			input:     "d1:a",
+			read:      func(r Reader) (interface{}, error) { return nil, Skip(r) },
+			errOffset: 4,
+			errMsg:    "unexpected end of input",
+		},
+		{
+			name:   "digits",
+			input:  "-12:",
+			read:   func(r Reader) (interface{}, error) { return readDigits(r, ':', true) },
+			want:   "-12",
+			offset: 4,
+		},
+		{
+			name:      "digits unsigned",
+			input:     "-12:",
+			read:      func(r Reader) (interface{}, error) { return readDigits(r, ':', false) },
+			errOffset: 0,
+			errMsg:    "unexpected '-' in number",
+		},
+		{
+			name:      "digits sign only",
+			input:     "-e",
+			read:      func(r Reader) (interface{}, error) { return readDigits(r, 'e', true) },
+			errOffset: 1,
+			errMsg:    "missing digits",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDecoder(strings.NewReader(test.input))
+			got, err := test.read(d)
+			checkErr(t, err, test.errOffset, test.errMsg)
+			if test.errMsg != "" {
+				return
+			}
+			if test.want != nil && !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("expected %#v, got %#v", test.want, got)
+			}
+			if d.Offset() != test.offset {
+				t.Fatalf("expected to stop at offset %d, got %d", test.offset, d.Offset())
+			}
+		})
+	}
+}
+
+func TestCanonicalInt(t *testing.T) {
+	tests := []struct {
+		s      string
+		signed bool
+		want   bool
+	}{
+		{"0", false, true},
+		{"7", false, true},
+		{"1234567890", false, true},
+		{"-1", true, true},
+		{"-1", false, false},
+		{"-0", true, false},
+		{"00", false, false},
+		{"01", false, false},
+		{"-01", true, false},
+		{"", false, false},
+		{"-", true, false},
+		{"+1", true, false},
+		{"1a", false, false},
+	}
+
+	for _, test := range tests {
+		if got := canonicalInt(test.s, test.signed); got != test.want {
+			t.Errorf("canonicalInt(%q, %v) = %v, expected %v", test.s, test.signed, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package pkg
+
+import (
+	"time"
+)
+
+type Rounding int
+
+const (
+	// RoundTrunc rounds towards zero
+	RoundTrunc Rounding = iota
+	RoundFloor
+	RoundCeil
+	// RoundNearest rounds halfway values away from zero, like time.Duration.Round
+	RoundNearest
+)
+
+// DurationUnits returns d as a whole number of units, rounded according to mode
+func DurationUnits(d time.Duration, unit time.Duration, mode Rounding) int64 {
+	q, r := d/unit, d%unit
+	switch mode {
+	case RoundFloor:
+		if r < 0 {
+			q--
+		}
+	case RoundCeil:
+		if r > 0 {
+			q++
+		}
+	case RoundNearest:
+		// Compare against the remaining distance, as doubling r could overflow
+		if r > 0 && r >= unit-r {
+			q++
+		} else if r < 0 && -r >= unit+r {
+			q--
+		}
+	}
+	return int64(q)
+}
+
+// ReadDuration reads an integer number of units, failing if the result can't be represented
+func ReadDuration(r Reader, unit time.Duration) (time.Duration, error) {
+	n, err := ReadInt(r, 64)
+	if err != nil {
+		return 0, err
+	}
+	d := time.Duration(n) * unit
+	if n != 0 && d/time.Duration(n) != unit {
+		return 0, syntaxError(r, "duration of %d * %v out of range", n, unit)
+	}
+	return d, nil
+}
@@ -0,0 +1,85 @@
+package pkg
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDurationUnits(t *testing.T) {
+	tests := []struct {
+		d, unit time.Duration
+		mode    Rounding
+		want    int64
+	}{
+		{1500 * time.Millisecond, time.Second, RoundTrunc, 1},
+		{-1500 * time.Millisecond, time.Second, RoundTrunc, -1},
+		{1500 * time.Millisecond, time.Second, RoundFloor, 1},
+		{-1500 * time.Millisecond, time.Second, RoundFloor, -2},
+		{-2 * time.Second, time.Second, RoundFloor, -2},
+		{1500 * time.Millisecond, time.Second, RoundCeil, 2},
+		{-1500 * time.Millisecond, time.Second, RoundCeil, -1},
+		{2 * time.Second, time.Second, RoundCeil, 2},
+		{1500 * time.Millisecond, time.Second, RoundNearest, 2},
+		{-1500 * time.Millisecond, time.Second, RoundNearest, -2},
+		{1499 * time.Millisecond, time.Second, RoundNearest, 1},
+		{-1499 * time.Millisecond, time.Second, RoundNearest, -1},
+		// Odd units have no exact halfway point
+		{4, 3, RoundNearest, 1},
+		{5, 3, RoundNearest, 2},
+		{-4, 3, RoundNearest, -1},
+		{-5, 3, RoundNearest, -2},
+		// Rounding the extremes mustn't overflow
+		{math.MaxInt64, time.Second, RoundNearest, 9223372037},
+		{math.MinInt64, time.Second, RoundNearest, -9223372037},
+		{math.MaxInt64, time.Second, RoundCeil, 9223372037},
+		{math.MinInt64, time.Second, RoundFloor, -9223372037},
+		{math.MaxInt64, time.Nanosecond, RoundNearest, math.MaxInt64},
+	}
+
+	for _, test := range tests {
+		if got := DurationUnits(test.d, test.unit, test.mode); got != test.want {
+			t.Errorf("DurationUnits(%v, %v, %v) = %v, expected %v", test.d, test.unit, test.mode, got, test.want)
+		}
+	}
+}
+
+func TestReadDuration(t *testing.T) {
+	tests := []struct {
+		input string
+		unit  time.Duration
+		want  time.Duration
+		// Expected error message, if any
+		errMsg string
+	}{
+		{"i5e", time.Millisecond, 5 * time.Millisecond, ""},
+		{"i-5e", time.Second, -5 * time.Second, ""},
+		{"i0e", time.Hour, 0, ""},
+		{"i9223372036854775807e", time.Nanosecond, math.MaxInt64, ""},
+		{"i9223372036e", time.Second, 9223372036 * time.Second, ""},
+		{"i-9223372036e", time.Second, -9223372036 * time.Second, ""},
+		{"i9223372037e", time.Second, 0, "out of range"},
+		{"i-9223372037e", time.Second, 0, "out of range"},
+		{"i4611686018427387904e", 4, 0, "out of range"},
+		{"1:a", time.Second, 0, "expected 'i'"},
+	}
+
+	for _, test := range tests {
+		got, err := ReadDuration(NewDecoder(strings.NewReader(test.input)), test.unit)
+		if test.errMsg != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+				t.Errorf("ReadDuration(%q, %v) returned error %v, expected one containing %q",
+					test.input, test.unit, err, test.errMsg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ReadDuration(%q, %v) returned error %v", test.input, test.unit, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ReadDuration(%q, %v) = %v, expected %v", test.input, test.unit, got, test.want)
+		}
+	}
+}
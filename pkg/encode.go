@@ -0,0 +1,224 @@
+package pkg
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// DuplicateKeyError is returned when two distinct map keys encode to the same dict key
+type DuplicateKeyError struct {
+	Key string
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return "bencode: duplicate dict key " + strconv.Quote(e.Key)
+}
+
+// NilPointerError is returned when a nil pointer is encoded by a field using the error nil mode
+type NilPointerError struct {
+	// Path to the nil field or element, such as Torrent.Info or Peers.List[], or the pointer type of a dynamic value
+	Path string
+}
+
+func (e *NilPointerError) Error() string {
+	return "bencode: nil pointer at " + e.Path
+}
+
+// UnsupportedTypeError is returned when a dynamically typed value has no bencode representation
+type UnsupportedTypeError struct {
+	Value interface{}
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("bencode: unsupported type %T", e.Value)
+}
+
+// WriteValue encodes a value whose type is only known at runtime, such as an interface{} field
+func WriteValue(w Writer, v interface{}) error {
+	// Typed nil pointers would otherwise reach a WriteTo method which dereferences them
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return &NilPointerError{Path: rv.Type().String()}
+	}
+	switch v := v.(type) {
+	case Bencodable:
+		return v.WriteTo(w)
+	case string:
+		return writeString(w, v)
+	case []byte:
+		return writeBytes(w, v)
+	case int:
+		return writeInt(w, int64(v))
+	case int8:
+		return writeInt(w, int64(v))
+	case int16:
+		return writeInt(w, int64(v))
+	case int32:
+		return writeInt(w, int64(v))
+	case int64:
+		return writeInt(w, v)
+	case uint:
+		return writeUint(w, uint64(v))
+	case uint8:
+		return writeUint(w, uint64(v))
+	case uint16:
+		return writeUint(w, uint64(v))
+	case uint32:
+		return writeUint(w, uint64(v))
+	case uint64:
+		return writeUint(w, v)
+	case bool:
+		if v {
+			return writeInt(w, 1)
+		}
+		return writeInt(w, 0)
+	case []interface{}:
+		if err := w.WriteByte('l'); err != nil {
+			return err
+		}
+		for _, elem := range v {
+			if err := WriteValue(w, elem); err != nil {
+				return err
+			}
+		}
+		return w.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if err := w.WriteByte('d'); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := writeString(w, k); err != nil {
+				return err
+			}
+			if err := WriteValue(w, v[k]); err != nil {
+				return err
+			}
+		}
+		return w.WriteByte('e')
+	}
+	return writeReflect(w, reflect.ValueOf(v))
+}
+
+// writeReflect encodes a value by its kind, for types which WriteValue doesn't know by name
+// These are usually type parameter fields, which are passed by pointer and may be named types such as time.Month
+func writeReflect(w Writer, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		// Pointer type arguments, such as *Info in Response[*Info], are passed as **Info
+		// WriteValue already rejected a nil outer pointer, and rejects a nil inner one in turn
+		return WriteValue(w, v.Elem().Interface())
+	case reflect.Interface:
+		return WriteValue(w, v.Elem().Interface())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return writeInt(w, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return writeUint(w, v.Uint())
+	case reflect.Bool:
+		if v.Bool() {
+			return writeInt(w, 1)
+		}
+		return writeInt(w, 0)
+	case reflect.String:
+		return writeString(w, v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return writeBytes(w, b)
+		}
+		if err := w.WriteByte('l'); err != nil {
+			return err
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := WriteValue(w, addressed(v.Index(i))); err != nil {
+				return err
+			}
+		}
+		return w.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			break
+		}
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		if err := w.WriteByte('d'); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := writeString(w, k); err != nil {
+				return err
+			}
+			key := reflect.ValueOf(k).Convert(v.Type().Key())
+			if err := WriteValue(w, addressed(v.MapIndex(key))); err != nil {
+				return err
+			}
+		}
+		return w.WriteByte('e')
+	}
+	if !v.IsValid() {
+		return &UnsupportedTypeError{nil}
+	}
+	return &UnsupportedTypeError{v.Interface()}
+}
+
+// addressed returns a pointer to v, copying it if need be, so that methods with pointer receivers are found
+func addressed(v reflect.Value) interface{} {
+	if v.CanAddr() {
+		return v.Addr().Interface()
+	}
+	ptr := reflect.New(v.Type())
+	ptr.Elem().Set(v)
+	return ptr.Interface()
+}
+
+func writeInt(w Writer, n int64) error {
+	if err := w.WriteByte('i'); err != nil {
+		return err
+	}
+	if _, err := w.WriteString(strconv.FormatInt(n, 10)); err != nil {
+		return err
+	}
+	return w.WriteByte('e')
+}
+
+func writeUint(w Writer, n uint64) error {
+	if err := w.WriteByte('i'); err != nil {
+		return err
+	}
+	if _, err := w.WriteString(strconv.FormatUint(n, 10)); err != nil {
+		return err
+	}
+	return w.WriteByte('e')
+}
+
+func writeString(w Writer, s string) error {
+	if err := writeLength(w, len(s)); err != nil {
+		return err
+	}
+	_, err := w.WriteString(s)
+	return err
+}
+
+func writeBytes(w Writer, b []byte) error {
+	if err := writeLength(w, len(b)); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func writeLength(w Writer, n int) error {
+	if _, err := w.WriteString(strconv.Itoa(n)); err != nil {
+		return err
+	}
+	return w.WriteByte(':')
+}
@@ -0,0 +1,119 @@
+package pkg
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testInfo stands in for a generated type, whose methods have pointer receivers and dereference them
+type testInfo struct {
+	Name string
+}
+
+func (x *testInfo) WriteTo(w Writer) error {
+	return writeString(w, x.Name)
+}
+
+func (x *testInfo) ReadFrom(r Reader) (err error) {
+	x.Name, err = ReadString(r)
+	return
+}
+
+// testEnum is a named type which WriteValue and ReadInto only know by its kind
+type testEnum int
+
+func TestWriteValue(t *testing.T) {
+	enum := testEnum(3)
+	info, nilInfo := &testInfo{"n"}, (*testInfo)(nil)
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+		err   error
+	}{
+		{"string", "str", "3:str", nil},
+		{"bytes", []byte("ab"), "2:ab", nil},
+		{"int8", int8(-1), "i-1e", nil},
+		{"uint64", uint64(math.MaxUint64), "i18446744073709551615e", nil},
+		{"bool", true, "i1e", nil},
+		{"list", []interface{}{1, "a"}, "li1e1:ae", nil},
+		{"dict", map[string]interface{}{"b": 1, "a": 2}, "d1:ai2e1:bi1ee", nil},
+		{"bencodable", &testInfo{"n"}, "1:n", nil},
+		{"nil bencodable", (*testInfo)(nil), "", &NilPointerError{Path: "*pkg.testInfo"}},
+		{"nil int", (*int)(nil), "", &NilPointerError{Path: "*int"}},
+		{"named int", &enum, "i3e", nil},
+		{"pointer argument", &info, "1:n", nil},
+		{"nil pointer argument", &nilInfo, "", &NilPointerError{Path: "*pkg.testInfo"}},
+		{"nil pointer element", []*testInfo{info, nil}, "", &NilPointerError{Path: "*pkg.testInfo"}},
+		{"nil pointer value", map[string]*testInfo{"k": nil}, "", &NilPointerError{Path: "*pkg.testInfo"}},
+		{"byte array", [2]byte{'a', 'b'}, "2:ab", nil},
+		{"bencodable slice", []testInfo{{"a"}, {"b"}}, "l1:a1:be", nil},
+		{"bencodable map", map[string]testInfo{"k": {"v"}}, "d1:k1:ve", nil},
+		{"int keys", map[int]int{1: 1}, "", &UnsupportedTypeError{map[int]int{1: 1}}},
+		{"float", 1.5, "", &UnsupportedTypeError{1.5}},
+		{"nil", nil, "", &UnsupportedTypeError{nil}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out strings.Builder
+			err := WriteValue(&out, test.value)
+			if !reflect.DeepEqual(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if err == nil && out.String() != test.want {
+				t.Fatalf("expected %q, got %q", test.want, out.String())
+			}
+		})
+	}
+}
+
+func TestReadInto(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		dst   interface{}
+		want  interface{}
+		// Expected error message, if any
+		errMsg string
+	}{
+		{name: "string", input: "3:str", dst: new(string), want: "str"},
+		{name: "bytes", input: "2:ab", dst: new([]byte), want: []byte("ab")},
+		{name: "int8", input: "i-5e", dst: new(int8), want: int8(-5)},
+		{name: "uint8 overflow", input: "i300e", dst: new(uint8), errMsg: "out of range"},
+		{name: "bool", input: "i1e", dst: new(bool), want: true},
+		{name: "value", input: "li1e1:ae", dst: new(interface{}), want: []interface{}{int64(1), "a"}},
+		{name: "list mismatch", input: "i1e", dst: new([]interface{}), errMsg: "expected a list"},
+		{name: "unmarshaler", input: "1:n", dst: new(testInfo), want: testInfo{"n"}},
+		{name: "pointer", input: "1:n", dst: new(*testInfo), want: &testInfo{"n"}},
+		{name: "named int", input: "i3e", dst: new(testEnum), want: testEnum(3)},
+		{name: "byte array", input: "2:ab", dst: new([2]byte), want: [2]byte{'a', 'b'}},
+		{name: "array", input: "li1ei2ee", dst: new([2]int), want: [2]int{1, 2}},
+		{name: "array overflow", input: "li1ei2ee", dst: new([1]int), errMsg: ErrArrayLength.Error()},
+		{name: "slice", input: "l1:a1:be", dst: new([]testInfo), want: []testInfo{{"a"}, {"b"}}},
+		{name: "map", input: "d1:ai1ee", dst: new(map[string]int), want: map[string]int{"a": 1}},
+		{name: "int keys", input: "de", dst: new(map[int]int), errMsg: "unsupported type"},
+		{name: "nil unmarshaler", input: "1:n", dst: (*testInfo)(nil), errMsg: "unsupported type"},
+		{name: "not a pointer", input: "i1e", dst: testEnum(1), errMsg: "unsupported type"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ReadInto(NewDecoder(strings.NewReader(test.input)), test.dst)
+			if test.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+					t.Fatalf("expected an error containing %q, got %v", test.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := reflect.ValueOf(test.dst).Elem().Interface(); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("expected %#v, got %#v", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+)
+
+// FloatRangeError is returned when a float using the scale option can't be written as an integer
+type FloatRangeError struct {
+	Value float64
+	Scale float64
+}
+
+func (e *FloatRangeError) Error() string {
+	return fmt.Sprintf("bencode: %v scaled by %v is out of range", e.Value, e.Scale)
+}
+
+// ScaleFloat returns f multiplied by scale, rounded to the nearest integer
+// NaN, infinities and anything else outside the range of an int64 are an error, rather than being mangled
+func ScaleFloat(f float64, scale float64) (int64, error) {
+	scaled := math.Round(f * scale)
+	// math.MaxInt64 isn't representable, and rounds up to 2^63 when converted, which is out of range itself
+	if math.IsNaN(scaled) || scaled < math.MinInt64 || scaled >= math.MaxInt64 {
+		return 0, &FloatRangeError{Value: f, Scale: scale}
+	}
+	return int64(scaled), nil
+}
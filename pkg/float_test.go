@@ -0,0 +1,39 @@
+package pkg
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestScaleFloat(t *testing.T) {
+	tests := []struct {
+		f, scale float64
+		want     int64
+		err      bool
+	}{
+		{1.5, 1, 2, false},
+		{-1.5, 1, -2, false},
+		{0.125, 1000, 125, false},
+		{1, 1e18, 1e18, false},
+		{math.NaN(), 1, 0, true},
+		{math.Inf(1), 1, 0, true},
+		{math.Inf(-1), 1, 0, true},
+		{1e19, 1, 0, true},
+		{-1e19, 1, 0, true},
+		{1, math.MaxInt64, 0, true},
+		{math.MinInt64, 1, math.MinInt64, false},
+	}
+
+	for _, test := range tests {
+		got, err := ScaleFloat(test.f, test.scale)
+		var rangeErr *FloatRangeError
+		if test.err != errors.As(err, &rangeErr) {
+			t.Errorf("ScaleFloat(%v, %v) returned error %v", test.f, test.scale, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ScaleFloat(%v, %v) = %v, expected %v", test.f, test.scale, got, test.want)
+		}
+	}
+}
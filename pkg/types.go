@@ -8,6 +8,15 @@ type Writer interface {
 	io.Writer
 }
 
+type Reader interface {
+	io.ByteScanner
+	io.Reader
+}
+
 type Bencodable interface {
 	WriteTo(Writer) error
 }
+
+type Unmarshaler interface {
+	ReadFrom(Reader) error
+}